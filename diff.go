@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around every change in a unified diff
+const diffContext = 3
+
+// maxDiffEdits bounds the work done to find the smallest diff. Past it, the changed region is reported
+// as removed and added as a whole, which is still a valid diff, only a longer one.
+const maxDiffEdits = 1000
+
+// diffLine is a line of a diff: ' ' for a line kept as is, '-' for a removed line and '+' for an added one
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// splitLines splits text into lines, keeping the line endings so the text can be rebuilt exactly
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the lines to keep, remove and add to turn a into b
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	lines := make([]diffLine, 0, len(a)+len(b)-prefix-suffix)
+	for _, line := range a[:prefix] {
+		lines = append(lines, diffLine{' ', line})
+	}
+	lines = append(lines, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', line})
+	}
+	return lines
+}
+
+// myersDiff finds the smallest diff between a and b with the Myers algorithm, keeping the furthest point
+// reached on every diagonal after each step so the path can be walked back
+func myersDiff(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	trace := [][]int{}
+
+	for d := 0; d <= n+m; d++ {
+		if d > maxDiffEdits {
+			lines := make([]diffLine, 0, n+m)
+			for _, line := range a {
+				lines = append(lines, diffLine{'-', line})
+			}
+			for _, line := range b {
+				lines = append(lines, diffLine{'+', line})
+			}
+			return lines
+		}
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+		}
+		trace = append(trace, slices.Clone(v[offset-d:offset+d+1]))
+
+		if v[offset+n-m] >= n && n-m >= -d && n-m <= d {
+			break
+		}
+	}
+
+	lines := []diffLine{}
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		previous := trace[d-1]
+		at := func(k int) int { return previous[k+d-1] }
+
+		k := x - y
+		previousK := k - 1
+		if k == -d || k != d && at(k-1) < at(k+1) {
+			previousK = k + 1
+		}
+		previousX := at(previousK)
+		previousY := previousX - previousK
+
+		for x > previousX && y > previousY {
+			lines = append(lines, diffLine{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == previousX {
+			lines = append(lines, diffLine{'+', b[y-1]})
+			y--
+		} else {
+			lines = append(lines, diffLine{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		lines = append(lines, diffLine{' ', a[x-1]})
+		x--
+		y--
+	}
+
+	slices.Reverse(lines)
+	return lines
+}
+
+// unifiedDiff returns the changes between two versions of a file in the unified diff format, or an
+// empty string when they are the same
+func unifiedDiff(oldName, newName, oldText, newText string) string {
+	lines := diffLines(splitLines(oldText), splitLines(newText))
+
+	// Line numbers, in the old and new file, of the line at every position of the diff
+	oldLine := make([]int, len(lines)+1)
+	newLine := make([]int, len(lines)+1)
+	for i, line := range lines {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if line.kind != '+' {
+			oldLine[i+1]++
+		}
+		if line.kind != '-' {
+			newLine[i+1]++
+		}
+	}
+
+	var diff strings.Builder
+	for i := 0; i < len(lines); {
+		for i < len(lines) && lines[i].kind == ' ' {
+			i++
+		}
+		if i == len(lines) {
+			break
+		}
+
+		// Changes separated by no more than twice the context go in the same hunk
+		last := i
+		for j := i; j < len(lines) && j-last-1 <= 2*diffContext; j++ {
+			if lines[j].kind != ' ' {
+				last = j
+			}
+		}
+		start := max(i-diffContext, 0)
+		end := min(last+diffContext+1, len(lines))
+
+		if diff.Len() == 0 {
+			fmt.Fprintf(&diff, "--- %s\n+++ %s\n", oldName, newName)
+		}
+		fmt.Fprintf(&diff, "@@ -%s +%s @@\n",
+			hunkRange(oldLine[start], oldLine[end]-oldLine[start]),
+			hunkRange(newLine[start], newLine[end]-newLine[start]),
+		)
+		for _, line := range lines[start:end] {
+			diff.WriteByte(line.kind)
+			diff.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				diff.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return diff.String()
+}
+
+// hunkRange formats the start line and number of lines of a hunk. An empty range starts at the line
+// before it, as diff does.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// maxPatchFuzz is the number of context lines that may be ignored at each end of a hunk when its full
+// context is not found, as patch does with its fuzz factor
+const maxPatchFuzz = 2
+
+// filePatch holds the changes a patch makes to one file. oldName is empty when the file is created and
+// newName is empty when it is deleted.
+type filePatch struct {
+	oldName string
+	newName string
+	hunks   []patchHunk
+}
+
+type patchHunk struct {
+	oldStart int
+	oldCount int
+	newStart int
+	newCount int
+	lines    []diffLine
+}
+
+func (h patchHunk) header() string {
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", h.oldStart, h.oldCount, h.newStart, h.newCount)
+}
+
+// parsePatch reads a unified diff, possibly changing several files. Lines outside of the file headers
+// and hunks, such as the ones added by git, are ignored. The a/ and b/ prefixes git adds to the names
+// are removed.
+func parsePatch(text string) ([]filePatch, error) {
+	lines := splitLines(text)
+	patches := []filePatch{}
+
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "--- ") || i+1 == len(lines) || !strings.HasPrefix(lines[i+1], "+++ ") {
+			continue
+		}
+		patch := filePatch{oldName: patchFileName(lines[i][4:]), newName: patchFileName(lines[i+1][4:])}
+		if strings.HasPrefix(patch.oldName, "a/") && strings.HasPrefix(patch.newName, "b/") ||
+			patch.oldName == "" && strings.HasPrefix(patch.newName, "b/") ||
+			strings.HasPrefix(patch.oldName, "a/") && patch.newName == "" {
+			patch.oldName = strings.TrimPrefix(patch.oldName, "a/")
+			patch.newName = strings.TrimPrefix(patch.newName, "b/")
+		}
+		if patch.oldName == "" && patch.newName == "" {
+			return nil, fmt.Errorf("line %d: file header without a file name", i+1)
+		}
+		i += 2
+
+		for i < len(lines) && strings.HasPrefix(lines[i], "@@ ") {
+			hunk := patchHunk{}
+			if err := parseHunkHeader(lines[i], &hunk); err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+			i++
+
+			oldLeft, newLeft := hunk.oldCount, hunk.newCount
+			for oldLeft > 0 || newLeft > 0 {
+				if i == len(lines) {
+					return nil, fmt.Errorf("hunk %s of %s ends before all of its lines", hunk.header(), patch.displayName())
+				}
+				line := lines[i]
+				kind := byte(' ')
+				if line != "\n" {
+					kind = line[0]
+					line = line[1:]
+				}
+				switch kind {
+				case ' ':
+					oldLeft--
+					newLeft--
+				case '-':
+					oldLeft--
+				case '+':
+					newLeft--
+				case '\\':
+					// "\ No newline at end of file" applies to the line before it
+					if n := len(hunk.lines); n > 0 {
+						hunk.lines[n-1].text = strings.TrimSuffix(hunk.lines[n-1].text, "\n")
+					}
+					i++
+					continue
+				default:
+					return nil, fmt.Errorf("line %d: unexpected line in hunk %s of %s", i+1, hunk.header(), patch.displayName())
+				}
+				if oldLeft < 0 || newLeft < 0 {
+					return nil, fmt.Errorf("line %d: hunk %s of %s has more lines than its header says", i+1, hunk.header(), patch.displayName())
+				}
+				hunk.lines = append(hunk.lines, diffLine{kind, line})
+				i++
+			}
+			if i < len(lines) && strings.HasPrefix(lines[i], "\\") {
+				n := len(hunk.lines)
+				hunk.lines[n-1].text = strings.TrimSuffix(hunk.lines[n-1].text, "\n")
+				i++
+			}
+			patch.hunks = append(patch.hunks, hunk)
+		}
+		i--
+
+		patches = append(patches, patch)
+	}
+
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("no file changes found, the patch must be in the unified diff format")
+	}
+	return patches, nil
+}
+
+func (p filePatch) displayName() string {
+	if p.newName != "" {
+		return p.newName
+	}
+	return p.oldName
+}
+
+// patchFileName returns the file name of a "---" or "+++" line, without the timestamp diff may add after
+// a tab, or an empty name for /dev/null
+func patchFileName(value string) string {
+	name, _, _ := strings.Cut(strings.TrimRight(value, "\r\n"), "\t")
+	name = strings.TrimSpace(name)
+	if name == "/dev/null" {
+		return ""
+	}
+	return name
+}
+
+func parseHunkHeader(line string, hunk *patchHunk) error {
+	header, _, found := strings.Cut(strings.TrimPrefix(line, "@@ "), " @@")
+	oldRange, newRange, ok := strings.Cut(header, " ")
+	if !found || !ok || !strings.HasPrefix(oldRange, "-") || !strings.HasPrefix(newRange, "+") {
+		return fmt.Errorf("invalid hunk header %q", strings.TrimSpace(line))
+	}
+
+	parseRange := func(value string, start, count *int) error {
+		first, second, hasCount := strings.Cut(value, ",")
+		*count = 1
+		if _, err := fmt.Sscanf(first, "%d", start); err != nil {
+			return fmt.Errorf("invalid hunk header %q", strings.TrimSpace(line))
+		}
+		if hasCount {
+			if _, err := fmt.Sscanf(second, "%d", count); err != nil {
+				return fmt.Errorf("invalid hunk header %q", strings.TrimSpace(line))
+			}
+		}
+		return nil
+	}
+	if err := parseRange(oldRange[1:], &hunk.oldStart, &hunk.oldCount); err != nil {
+		return err
+	}
+	return parseRange(newRange[1:], &hunk.newStart, &hunk.newCount)
+}
+
+// applyHunks applies the hunks of a file patch to its content. A hunk whose context is not found at the
+// line it gives is looked for further away, then with trailing whitespace ignored, then with up to
+// maxPatchFuzz context lines left out at each end. The notes tell where hunks were applied differently
+// from the patch, and the rejections which hunks could not be applied.
+func applyHunks(content string, hunks []patchHunk) (string, []string, []string) {
+	lines := splitLines(content)
+	notes := []string{}
+	rejections := []string{}
+
+	delta := 0 // lines added minus lines removed by the hunks applied so far
+	drift := 0 // distance between where the last hunk was found and where the patch placed it
+	minPos := 0
+	for i, hunk := range hunks {
+		// An empty old range gives the line before the hunk
+		base := hunk.oldStart - 1 + delta
+		if hunk.oldCount == 0 {
+			base++
+		}
+
+		pos, fuzz, loose, found := findHunk(lines, hunk, base+drift, minPos)
+		if !found {
+			rejections = append(rejections, fmt.Sprintf("hunk %d %s: context not found", i+1, hunk.header()))
+			continue
+		}
+
+		lead, trail := hunkFuzz(hunk, fuzz)
+		drift = pos - lead - base
+
+		// Context lines keep the text of the file, which may differ in whitespace from the patch
+		replacement := []string{}
+		at := pos
+		for _, line := range hunk.lines[lead : len(hunk.lines)-trail] {
+			switch line.kind {
+			case ' ':
+				replacement = append(replacement, lines[at])
+				at++
+			case '-':
+				at++
+			case '+':
+				replacement = append(replacement, line.text)
+			}
+		}
+		lines = slices.Concat(lines[:pos], replacement, lines[at:])
+		delta += len(replacement) - (at - pos)
+		minPos = pos + len(replacement)
+
+		switch {
+		case fuzz > 0:
+			notes = append(notes, fmt.Sprintf("hunk %d applied at line %d with fuzz %d", i+1, pos+1, fuzz))
+		case loose:
+			notes = append(notes, fmt.Sprintf("hunk %d applied at line %d ignoring whitespace", i+1, pos+1))
+		case drift != 0:
+			notes = append(notes, fmt.Sprintf("hunk %d applied at line %d (offset %d lines)", i+1, pos+1, drift))
+		}
+	}
+
+	return strings.Join(lines, ""), notes, rejections
+}
+
+// hunkFuzz returns the number of context lines left out at the start and end of a hunk for a fuzz factor
+func hunkFuzz(hunk patchHunk, fuzz int) (int, int) {
+	lead := 0
+	for lead < fuzz && lead < len(hunk.lines) && hunk.lines[lead].kind == ' ' {
+		lead++
+	}
+	trail := 0
+	for trail < fuzz && trail < len(hunk.lines)-lead && hunk.lines[len(hunk.lines)-1-trail].kind == ' ' {
+		trail++
+	}
+	return lead, trail
+}
+
+// findHunk looks for the lines a hunk expects in the file, starting at the expected line and moving
+// away from it in both directions, without going back before minPos
+func findHunk(lines []string, hunk patchHunk, expected, minPos int) (int, int, bool, bool) {
+	for fuzz := 0; fuzz <= maxPatchFuzz; fuzz++ {
+		lead, trail := hunkFuzz(hunk, fuzz)
+		if fuzz > 0 && lead+trail == 0 {
+			break
+		}
+		want := []string{}
+		for _, line := range hunk.lines[lead : len(hunk.lines)-trail] {
+			if line.kind != '+' {
+				want = append(want, line.text)
+			}
+		}
+
+		for _, loose := range []bool{false, true} {
+			start := expected + lead
+			for distance := 0; start-distance >= minPos || start+distance+len(want) <= len(lines); distance++ {
+				candidates := []int{start - distance, start + distance}
+				if distance == 0 {
+					candidates = candidates[:1]
+				}
+				for _, pos := range candidates {
+					if pos >= minPos && pos+len(want) <= len(lines) && linesMatch(lines[pos:pos+len(want)], want, loose) {
+						return pos, fuzz, loose, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false, false
+}
+
+func linesMatch(lines, want []string, loose bool) bool {
+	for i := range want {
+		if lines[i] == want[i] {
+			continue
+		}
+		if !loose || strings.TrimRight(lines[i], " \t\r\n") != strings.TrimRight(want[i], " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
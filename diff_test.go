@@ -0,0 +1,218 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	lines := func(from, to int) string {
+		var b strings.Builder
+		for i := from; i <= to; i++ {
+			b.WriteString("line " + string(rune('a'+i-1)) + "\n")
+		}
+		return b.String()
+	}
+
+	tests := []struct {
+		name    string
+		oldText string
+		newText string
+		expect  string
+	}{
+		{
+			name:    "same content",
+			oldText: "a\nb\n",
+			newText: "a\nb\n",
+			expect:  "",
+		},
+		{
+			name:    "changed line",
+			oldText: "a\nb\nc\n",
+			newText: "a\nB\nc\n",
+			expect:  "--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name:    "added lines to an empty file",
+			oldText: "",
+			newText: "a\nb\n",
+			expect:  "--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name:    "missing newline at end of file",
+			oldText: "a\nb",
+			newText: "a\nb\n",
+			expect:  "--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name:    "distant changes in separate hunks",
+			oldText: lines(1, 20),
+			newText: strings.Replace(strings.Replace(lines(1, 20), "line b\n", "", 1), "line s\n", "line S\n", 1),
+			expect: "--- old\n+++ new\n" +
+				"@@ -1,5 +1,4 @@\n line a\n-line b\n line c\n line d\n line e\n" +
+				"@@ -16,5 +15,5 @@\n line p\n line q\n line r\n-line s\n+line S\n line t\n",
+		},
+		{
+			name:    "close changes in one hunk",
+			oldText: lines(1, 10),
+			newText: strings.Replace(strings.Replace(lines(1, 10), "line b\n", "line B\n", 1), "line h\n", "line H\n", 1),
+			expect: "--- old\n+++ new\n" +
+				"@@ -1,10 +1,10 @@\n line a\n-line b\n+line B\n line c\n line d\n line e\n line f\n line g\n-line h\n+line H\n line i\n line j\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unifiedDiff("old", "new", tt.oldText, tt.newText)
+			if got != tt.expect {
+				t.Errorf("Got:\n%s\nexpected:\n%s", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+	}{
+		{name: "interleaved changes", a: "a\nb\nc\nd\ne\nf\n", b: "a\nx\nc\ny\ne\nz\nf\n"},
+		{name: "reordered lines", a: "a\nb\nc\n", b: "c\nb\na\n"},
+		{name: "everything removed", a: "a\nb\n", b: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a, b strings.Builder
+			for _, line := range diffLines(splitLines(tt.a), splitLines(tt.b)) {
+				if line.kind != '+' {
+					a.WriteString(line.text)
+				}
+				if line.kind != '-' {
+					b.WriteString(line.text)
+				}
+			}
+			if a.String() != tt.a || b.String() != tt.b {
+				t.Errorf("Diff does not rebuild both sides, got %q and %q", a.String(), b.String())
+			}
+		})
+	}
+}
+
+func TestParsePatch(t *testing.T) {
+	patch := "diff --git a/main.go b/main.go\n" +
+		"index 83db48f..bf269f4 100644\n" +
+		"--- a/main.go\n" +
+		"+++ b/main.go\n" +
+		"@@ -1,2 +1,2 @@\n" +
+		" package main\n" +
+		"-var a = 1\n" +
+		"+var a = 2\n" +
+		"--- /dev/null\n" +
+		"+++ b/new.txt\n" +
+		"@@ -0,0 +1 @@\n" +
+		"+new\n" +
+		"\\ No newline at end of file\n"
+
+	patches, err := parsePatch(patch)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(patches) != 2 {
+		t.Fatalf("Got %d file patches, expected: 2", len(patches))
+	}
+
+	if patches[0].oldName != "main.go" || patches[0].newName != "main.go" {
+		t.Errorf("Got names %q and %q, expected: main.go", patches[0].oldName, patches[0].newName)
+	}
+	expectLines := []diffLine{{' ', "package main\n"}, {'-', "var a = 1\n"}, {'+', "var a = 2\n"}}
+	if len(patches[0].hunks) != 1 || !slices.Equal(patches[0].hunks[0].lines, expectLines) {
+		t.Errorf("Got hunks %+v, expected lines: %+v", patches[0].hunks, expectLines)
+	}
+
+	if patches[1].oldName != "" || patches[1].newName != "new.txt" {
+		t.Errorf("Got names %q and %q, expected a new file new.txt", patches[1].oldName, patches[1].newName)
+	}
+	if len(patches[1].hunks) != 1 || !slices.Equal(patches[1].hunks[0].lines, []diffLine{{'+', "new"}}) {
+		t.Errorf("Got hunks %+v, expected a line without newline", patches[1].hunks)
+	}
+
+	invalid := []string{
+		"not a patch\n",
+		"--- a/main.go\n+++ b/main.go\n@@ -1,3 +1,3 @@\n package main\n",
+		"--- a/main.go\n+++ b/main.go\n@@ -x +1 @@\n",
+	}
+	for _, patch := range invalid {
+		if _, err := parsePatch(patch); err == nil {
+			t.Errorf("Expected error parsing %q", patch)
+		}
+	}
+}
+
+func TestApplyHunks(t *testing.T) {
+	content := "a\nb\nc\nd\ne\nf\ng\nh\n"
+
+	tests := []struct {
+		name             string
+		patch            string
+		expect           string
+		expectNotes      int
+		expectRejections int
+	}{
+		{
+			name:   "exact position",
+			patch:  "@@ -3,3 +3,3 @@\n c\n-d\n+D\n e\n",
+			expect: "a\nb\nc\nD\ne\nf\ng\nh\n",
+		},
+		{
+			name:        "moved context",
+			patch:       "@@ -1,3 +1,3 @@\n f\n-g\n+G\n h\n",
+			expect:      "a\nb\nc\nd\ne\nf\nG\nh\n",
+			expectNotes: 1,
+		},
+		{
+			name:        "changed context with fuzz",
+			patch:       "@@ -3,5 +3,5 @@\n x\n c\n-d\n+D\n e\n y\n",
+			expect:      "a\nb\nc\nD\ne\nf\ng\nh\n",
+			expectNotes: 1,
+		},
+		{
+			name:        "whitespace differences",
+			patch:       "@@ -3,3 +3,3 @@\n c  \n-d\n+D\n e\n",
+			expect:      "a\nb\nc\nD\ne\nf\ng\nh\n",
+			expectNotes: 1,
+		},
+		{
+			name:   "several hunks",
+			patch:  "@@ -1,2 +1,3 @@\n a\n+a2\n b\n@@ -7,2 +8,2 @@\n g\n-h\n+H\n",
+			expect: "a\na2\nb\nc\nd\ne\nf\ng\nH\n",
+		},
+		{
+			name:             "context not found",
+			patch:            "@@ -3,3 +3,3 @@\n x\n-y\n+Y\n z\n",
+			expect:           content,
+			expectRejections: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patches, err := parsePatch("--- a/file\n+++ b/file\n" + tt.patch)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			got, notes, rejections := applyHunks(content, patches[0].hunks)
+			if got != tt.expect {
+				t.Errorf("Got %q, expected: %q", got, tt.expect)
+			}
+			if len(notes) != tt.expectNotes {
+				t.Errorf("Got notes %q, expected %d", notes, tt.expectNotes)
+			}
+			if len(rejections) != tt.expectRejections {
+				t.Errorf("Got rejections %q, expected %d", rejections, tt.expectRejections)
+			}
+		})
+	}
+}
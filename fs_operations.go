@@ -1,24 +1,78 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	"unicode/utf8"
 )
 
 type OperationResult struct {
-	Content string
-	Message string
-	Error   error
+	Content  string
+	Message  string
+	Error    error
+	Metadata map[string]any
+	// Structured is returned as the structured content of the tool result, Content then holds its JSON
+	// encoding for the clients that only read text
+	Structured any
 }
 
-// isSafePath checks if the given path is within the base directory and does not contain directory traversal
-func isSafePath(base, target string) bool {
+// symlinkPolicy controls how isSafePath treats symbolic links found along a path
+type symlinkPolicy int
+
+const (
+	// symlinkFollowWithinRoot follows links as long as their real target stays inside the base directory
+	symlinkFollowWithinRoot symlinkPolicy = iota
+	// symlinkDeny rejects any path that goes through a symbolic link below the base directory
+	symlinkDeny
+	// symlinkFollowAnywhere follows links wherever they point, only the path itself is checked
+	symlinkFollowAnywhere
+)
+
+func (p symlinkPolicy) String() string {
+	switch p {
+	case symlinkDeny:
+		return "deny"
+	case symlinkFollowAnywhere:
+		return "follow-anywhere"
+	default:
+		return "follow-within-root"
+	}
+}
+
+func parseSymlinkPolicy(value string) (symlinkPolicy, error) {
+	switch value {
+	case "deny":
+		return symlinkDeny, nil
+	case "follow-within-root", "":
+		return symlinkFollowWithinRoot, nil
+	case "follow-anywhere":
+		return symlinkFollowAnywhere, nil
+	}
+	return 0, fmt.Errorf("invalid symlink policy %q (use deny, follow-within-root or follow-anywhere)", value)
+}
+
+// isSafePath checks if the given path is within the base directory and does not contain directory traversal.
+// Symbolic links along the path are handled according to the given policy.
+func isSafePath(base, target string, policy symlinkPolicy) bool {
 	absBase, err := filepath.Abs(base)
 	if err != nil {
 		return false
@@ -27,11 +81,86 @@ func isSafePath(base, target string) bool {
 	if err != nil {
 		return false
 	}
-	return strings.HasPrefix(absTarget, absBase)
+	if !isWithin(absBase, absTarget) {
+		return false
+	}
+	if policy == symlinkFollowAnywhere {
+		return true
+	}
+
+	if policy == symlinkDeny {
+		rel, _ := filepath.Rel(absBase, absTarget)
+		current := absBase
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			if part == "." {
+				continue
+			}
+			current = filepath.Join(current, part)
+			info, err := os.Lstat(current)
+			if os.IsNotExist(err) {
+				break
+			}
+			if err != nil || info.Mode()&os.ModeSymlink != 0 {
+				return false
+			}
+		}
+	}
+
+	realBase, err := filepath.EvalSymlinks(absBase)
+	if err != nil {
+		return false
+	}
+	realTarget, err := resolveRealPath(absTarget)
+	if err != nil {
+		return false
+	}
+	return isWithin(realBase, realTarget)
 }
 
-func assertPath(path string) (os.FileInfo, error, bool) {
-	fileInfo, err := os.Stat(path)
+// resolveRealPath resolves every symbolic link in an absolute path. When the path does not exist yet,
+// the nearest existing parent is resolved and the missing components are joined back on top of it.
+func resolveRealPath(path string) (string, error) {
+	missing := []string{}
+	current := path
+	for {
+		_, err := os.Lstat(current)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			break
+		}
+		missing = append([]string{filepath.Base(current)}, missing...)
+		current = parent
+	}
+
+	// A dangling link makes EvalSymlinks fail, so it is never considered safe
+	resolved, err := filepath.EvalSymlinks(current)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{resolved}, missing...)...), nil
+}
+
+// isWithin reports whether target is base itself or lies below it. Both paths must be absolute.
+func isWithin(base, target string) bool {
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+func readOnlyResult(root *fsRoot) OperationResult {
+	return OperationResult{Message: fmt.Sprintf("access denied: root '%s' is read-only", root.name)}
+}
+
+func assertPath(root *fsRoot, path string) (os.FileInfo, error, bool) {
+	fileInfo, err := root.Stat(path)
 	if os.IsNotExist(err) {
 		return nil, nil, false
 	}
@@ -39,95 +168,1504 @@ func assertPath(path string) (os.FileInfo, error, bool) {
 		return nil, fmt.Errorf("error: %s", err), false
 	}
 
-	return fileInfo, nil, true
+	return fileInfo, nil, true
+}
+
+func listRoots(roots []*fsRoot) OperationResult {
+	allRoots := ""
+	for _, root := range roots {
+		mode := "read-write"
+		if root.readOnly {
+			mode = "read-only"
+		}
+		allRoots += fmt.Sprintf("- %s (root, %s): %s\n", root.name, mode, root.dir)
+	}
+	return OperationResult{Content: allRoots}
+}
+
+// entryFilter decides whether a directory entry is kept when walking a directory. A nil filter keeps
+// every entry. Filters are called by the walkTree workers, so they must be safe for concurrent use.
+type entryFilter func(path string, entry os.DirEntry) bool
+
+// combineFilters returns a filter keeping only the entries kept by every given filter
+func combineFilters(filters ...entryFilter) entryFilter {
+	active := []entryFilter{}
+	for _, filter := range filters {
+		if filter != nil {
+			active = append(active, filter)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+
+	return func(path string, entry os.DirEntry) bool {
+		for _, filter := range active {
+			if !filter(path, entry) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// walkWorkers is the number of directories walkTree reads at the same time
+const walkWorkers = 8
+
+// walkEntry is an entry found by walkTree
+type walkEntry struct {
+	// path is the path of the entry, joined to the directory walked
+	path string
+	// relPath is the slash separated path of the entry relative to the directory walked
+	relPath string
+	// depth is 0 for the entries of the directory walked, 1 for the entries of its subdirectories and so on
+	depth int
+	entry os.DirEntry
+	// info is loaded along with the directory when walkOptions.info is set, it is nil otherwise or when
+	// loading it failed
+	info os.FileInfo
+}
+
+// walkOptions controls which entries walkTree visits
+type walkOptions struct {
+	filter entryFilter
+	// maxDepth is the depth of the deepest entries visited, a negative maxDepth walks the whole tree
+	maxDepth int
+	// info makes the workers load the FileInfo of every entry, so visit does not stat them one by one
+	info bool
+}
+
+// descends reports whether the walk goes into a directory entry
+func (o walkOptions) descends(entry walkEntry) bool {
+	return entry.entry.IsDir() && (o.maxDepth < 0 || entry.depth < o.maxDepth)
+}
+
+// dirListing is the result of reading a directory for walkTree
+type dirListing struct {
+	entries []walkEntry
+	err     error
+}
+
+// dirJob asks a walkTree worker to read a directory and send its listing on result
+type dirJob struct {
+	path    string
+	relPath string
+	depth   int
+	result  chan dirListing
+}
+
+// readDirListing reads the directory of a job, keeping the entries kept by the filter
+func readDirListing(ctx context.Context, root *fsRoot, job dirJob, opts walkOptions) dirListing {
+	if err := ctx.Err(); err != nil {
+		return dirListing{err: err}
+	}
+	entries, err := root.ReadDir(job.path)
+	if err != nil {
+		return dirListing{err: err}
+	}
+
+	listing := dirListing{entries: make([]walkEntry, 0, len(entries))}
+	for _, entry := range entries {
+		entryPath := filepath.Join(job.path, entry.Name())
+		if opts.filter != nil && !opts.filter(entryPath, entry) {
+			continue
+		}
+		relPath := entry.Name()
+		if job.relPath != "" {
+			relPath = job.relPath + "/" + relPath
+		}
+		walked := walkEntry{path: entryPath, relPath: relPath, depth: job.depth, entry: entry}
+		if opts.info {
+			walked.info, _ = entry.Info()
+		}
+		listing.entries = append(listing.entries, walked)
+	}
+	return listing
+}
+
+// walkTree walks a directory and everything below it, calling visit for every entry kept by the filter.
+// Entries are visited depth first with the entries of each directory sorted by name, the same order as
+// filepath.WalkDir, while a pool of walkWorkers goroutines reads the directories coming next. visit is
+// only called from the calling goroutine. When it returns filepath.SkipDir for a directory the entries
+// below it are skipped, filepath.SkipAll ends the walk without error and any other error ends it and is
+// returned. Entries left out by the filter are not visited, nor is anything below them, and symlinks to
+// directories are not followed. The walk ends with the context error as soon as ctx is done.
+func walkTree(ctx context.Context, root *fsRoot, dir string, opts walkOptions, visit func(walkEntry) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan dirJob)
+	defer close(jobs)
+	for range walkWorkers {
+		go func() {
+			for job := range jobs {
+				job.result <- readDirListing(ctx, root, job, opts)
+			}
+		}()
+	}
+	read := func(path, relPath string, depth int) chan dirListing {
+		result := make(chan dirListing, 1)
+		jobs <- dirJob{path: path, relPath: relPath, depth: depth, result: result}
+		return result
+	}
+
+	var walk func(listed chan dirListing) error
+	walk = func(listed chan dirListing) error {
+		var listing dirListing
+		select {
+		case listing = <-listed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if listing.err != nil {
+			return listing.err
+		}
+
+		// Subdirectories are read up to walkWorkers ahead of the entry being visited, so the workers are
+		// kept busy without reading the whole tree before the walk gets there
+		subdirs := make([]chan dirListing, len(listing.entries))
+		next, pending := 0, 0
+		for i, entry := range listing.entries {
+			for ; next < len(listing.entries) && pending < walkWorkers; next++ {
+				if opts.descends(listing.entries[next]) {
+					subdirs[next] = read(listing.entries[next].path, listing.entries[next].relPath, listing.entries[next].depth+1)
+					pending++
+				}
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			err := visit(entry)
+			if subdirs[i] != nil {
+				pending--
+			}
+			if errors.Is(err, filepath.SkipDir) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if subdirs[i] != nil {
+				if err := walk(subdirs[i]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	err := walk(read(dir, "", 0))
+	if errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+// treeUsage is the space taken by the entries under a directory
+type treeUsage struct {
+	files       int
+	directories int
+	// size is the total size of the regular files, symlinks are counted as files but not followed
+	size int64
+	// extensions counts the files by lowercased extension, the files without one are counted under ""
+	extensions map[string]int
+	// newest and oldest are the files modified last and first, with paths relative to the directory
+	newest     string
+	newestTime time.Time
+	oldest     string
+	oldestTime time.Time
+}
+
+// measureTree walks a directory and everything below it, counting its files and subdirectories and adding
+// up the size of its files. Entries left out by the filter are not counted, nor is anything below them.
+func measureTree(ctx context.Context, root *fsRoot, path string, filter entryFilter) (treeUsage, error) {
+	usage := treeUsage{extensions: map[string]int{}}
+	err := walkTree(ctx, root, path, walkOptions{filter: filter, maxDepth: -1, info: true}, func(entry walkEntry) error {
+		if entry.entry.IsDir() {
+			usage.directories++
+			return nil
+		}
+		usage.files++
+		usage.extensions[strings.ToLower(filepath.Ext(entry.entry.Name()))]++
+		if entry.info == nil {
+			return nil
+		}
+		if entry.info.Mode().IsRegular() {
+			usage.size += entry.info.Size()
+		}
+		if modTime := entry.info.ModTime(); usage.newest == "" || modTime.After(usage.newestTime) {
+			usage.newest, usage.newestTime = entry.relPath, modTime
+		}
+		if modTime := entry.info.ModTime(); usage.oldest == "" || modTime.Before(usage.oldestTime) {
+			usage.oldest, usage.oldestTime = entry.relPath, modTime
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// deniedEntry walks a directory and returns the path of the first entry below it left out by the
+// filter, or an empty string when the filter keeps them all. Unlike the other walks, it goes on below
+// the entries left out, so the tree is checked as a whole before acting on it.
+func deniedEntry(ctx context.Context, root *fsRoot, path string, filter entryFilter) (string, error) {
+	if filter == nil {
+		return "", nil
+	}
+	denied := ""
+	err := walkTree(ctx, root, path, walkOptions{maxDepth: -1}, func(entry walkEntry) error {
+		if !filter(entry.path, entry.entry) {
+			denied = entry.path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return denied, err
+}
+
+// deniedMove returns path, or the path of the first entry below it, when the filter does not let it be
+// moved, or an empty string when everything can be moved
+func deniedMove(ctx context.Context, root *fsRoot, path string, info os.FileInfo, movable entryFilter) (string, error) {
+	if movable == nil {
+		return "", nil
+	}
+	if !movable(path, fs.FileInfoToDirEntry(info)) {
+		return path, nil
+	}
+	if !info.IsDir() {
+		return "", nil
+	}
+	return deniedEntry(ctx, root, path, movable)
+}
+
+const (
+	listFormatText = "text"
+	listFormatJSON = "json"
+
+	listSortName  = "name"
+	listSortSize  = "size"
+	listSortMtime = "mtime"
+)
+
+// listOptions controls which entries listEntries lists and how
+type listOptions struct {
+	// depth is the number of levels of subdirectories listed, a negative depth lists the whole tree
+	depth  int
+	format string
+	// showHidden lists the entries whose name starts with a dot, and what is below them
+	showHidden bool
+	// entryType, include and exclude select the entries listed. Directories not selected by entryType or
+	// include are still walked, and listed when something below them is, so the tree keeps its shape.
+	// Excluded entries are not listed, nor is anything below them.
+	entryType string
+	include   string
+	exclude   string
+	// sortBy orders the entries of each directory by name, by size with the largest first or by mtime
+	// with the newest first
+	sortBy string
+	// maxEntries caps the number of entries listed per directory, the others are summed up as "N more
+	// entries". 0 lists them all.
+	maxEntries int
+	// maxBytes caps the size of the json format. The deepest entries are left out until the tree fits,
+	// and the tree is marked as truncated. 0 sets no cap.
+	maxBytes int
+}
+
+// defaultListOptions lists three levels of subdirectories as text, with every entry sorted by name
+var defaultListOptions = listOptions{depth: 3, format: listFormatText, showHidden: true, sortBy: listSortName}
+
+// validate returns a message describing the first invalid option, or an empty string
+func (o listOptions) validate() string {
+	if o.format != listFormatText && o.format != listFormatJSON {
+		return fmt.Sprintf("invalid format %q, must be text or json", o.format)
+	}
+	if o.sortBy != listSortName && o.sortBy != listSortSize && o.sortBy != listSortMtime {
+		return fmt.Sprintf("invalid sortBy %q, must be name, size or mtime", o.sortBy)
+	}
+	if o.entryType != "" && o.entryType != entryTypeFile && o.entryType != entryTypeDirectory && o.entryType != entryTypeSymlink {
+		return fmt.Sprintf("invalid type %q, must be file, directory or symlink", o.entryType)
+	}
+	for _, pattern := range []string{o.include, o.exclude} {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Sprintf("invalid glob pattern %q: %s", pattern, err)
+		}
+	}
+	return ""
+}
+
+// selects reports whether an entry is one of the entries listed
+func (o listOptions) selects(entry *treeEntry) bool {
+	if o.entryType != "" && entry.Type != o.entryType {
+		return false
+	}
+	return o.include == "" || matchEntryGlob(o.include, entry.Path, entry.Name)
+}
+
+// arrange filters, sorts and caps the entries of a directory and of everything below it, returning the
+// entries listed and the number of entries left out by the cap
+func (o listOptions) arrange(entries []*treeEntry) ([]*treeEntry, int) {
+	listed := []*treeEntry{}
+	for _, entry := range entries {
+		if entry.Type == entryTypeDirectory {
+			entry.Entries, entry.More = o.arrange(entry.Entries)
+			if len(entry.Entries) > 0 || entry.More > 0 {
+				listed = append(listed, entry)
+				continue
+			}
+		}
+		if o.selects(entry) {
+			listed = append(listed, entry)
+		}
+	}
+
+	switch o.sortBy {
+	case listSortSize:
+		slices.SortStableFunc(listed, func(a, b *treeEntry) int {
+			return cmp.Compare(b.Size, a.Size)
+		})
+	case listSortMtime:
+		slices.SortStableFunc(listed, func(a, b *treeEntry) int {
+			return b.modTime.Compare(a.modTime)
+		})
+	}
+
+	if o.maxEntries > 0 && len(listed) > o.maxEntries {
+		return listed[:o.maxEntries], len(listed) - o.maxEntries
+	}
+	return listed, 0
+}
+
+// matchEntryGlob matches a glob like the patterns of path rules: against the name of an entry when the
+// pattern has no slash, and against its slash separated relative path otherwise
+func matchEntryGlob(pattern, relPath, name string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if strings.Contains(pattern, "/") {
+		return matchGlob(pattern, relPath)
+	}
+	ok, _ := filepath.Match(pattern, name)
+	return ok
+}
+
+// treeEntry is an entry of the tree listEntries builds before listing it
+type treeEntry struct {
+	Name string `json:"name"`
+	// Path is the slash separated path of the entry relative to the listed directory
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	Mode    string `json:"mode"`
+	ModTime string `json:"mtime"`
+	// Target is where a symlink points to, as stored in the link
+	Target string `json:"target,omitempty"`
+	// Entries are the entries of a directory, left empty for the directories below the listed depth
+	Entries []*treeEntry `json:"entries,omitempty"`
+	// More is the number of entries of a directory left out by the per directory cap
+	More int `json:"more,omitempty"`
+
+	modTime time.Time
+}
+
+func newTreeEntry(root *fsRoot, entry walkEntry) *treeEntry {
+	node := &treeEntry{Name: entry.entry.Name(), Path: entry.relPath, Type: entryType(entry.entry)}
+	if entry.info != nil {
+		node.Size = entry.info.Size()
+		node.Mode = entry.info.Mode().String()
+		node.modTime = entry.info.ModTime()
+		node.ModTime = node.modTime.Format(time.RFC3339)
+	}
+	if node.Type == entryTypeSymlink {
+		node.Target, _ = root.Readlink(entry.path)
+	}
+	return node
+}
+
+// writeTreeText writes entries as the indented list of the text format of listEntries
+func writeTreeText(text *strings.Builder, entries []*treeEntry, more int, prefix string) {
+	for _, entry := range entries {
+		pathType := "file"
+		if entry.Type == entryTypeDirectory {
+			pathType = "directory"
+		}
+		fmt.Fprintf(text, "%s- %s (%s)\n", prefix, entry.Name, pathType)
+		writeTreeText(text, entry.Entries, entry.More, prefix+"  ")
+	}
+	switch {
+	case more == 1:
+		fmt.Fprintf(text, "%s- ... 1 more entry\n", prefix)
+	case more > 1:
+		fmt.Fprintf(text, "%s- ... %d more entries\n", prefix, more)
+	}
+}
+
+// listEntries lists the entries of a directory selected by the options. The text format is an indented
+// list of names, the json format a nested tree with the details of every entry, returned as structured
+// content.
+func listEntries(ctx context.Context, root *fsRoot, path string, opts listOptions, filter entryFilter) OperationResult {
+	if message := opts.validate(); message != "" {
+		return OperationResult{Message: message}
+	}
+	info, err, exists := assertPath(root, path)
+	if err != nil {
+		return OperationResult{Error: err}
+	}
+	if !exists {
+		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
+	}
+	if !info.IsDir() {
+		return OperationResult{Message: "path is not a directory"}
+	}
+
+	if !opts.showHidden || opts.exclude != "" {
+		filter = combineFilters(filter, func(entryPath string, entry os.DirEntry) bool {
+			if !opts.showHidden && strings.HasPrefix(entry.Name(), ".") {
+				return false
+			}
+			if opts.exclude == "" {
+				return true
+			}
+			relPath, err := filepath.Rel(path, entryPath)
+			return err != nil || !matchEntryGlob(opts.exclude, filepath.ToSlash(relPath), entry.Name())
+		})
+	}
+
+	entries := []*treeEntry{}
+	// parents[d] holds the entries of the directory being walked at depth d, the walk going depth first
+	parents := []*[]*treeEntry{&entries}
+	walk := walkOptions{filter: filter, maxDepth: opts.depth, info: opts.format == listFormatJSON || opts.sortBy != listSortName}
+	err = walkTree(ctx, root, path, walk, func(entry walkEntry) error {
+		node := newTreeEntry(root, entry)
+		siblings := parents[entry.depth]
+		*siblings = append(*siblings, node)
+		parents = append(parents[:entry.depth+1], &node.Entries)
+		return nil
+	})
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
+	}
+	entries, more := opts.arrange(entries)
+
+	if opts.format == listFormatText {
+		var text strings.Builder
+		writeTreeText(&text, entries, more, "")
+		return OperationResult{Content: text.String()}
+	}
+
+	tree, encoded, err := encodeTree(path, opts.depth, entries, more, false)
+	if err == nil && opts.maxBytes > 0 && len(encoded) > opts.maxBytes {
+		tree, encoded, err = fitTree(path, opts.depth, entries, more, opts.maxBytes)
+	}
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error encoding the entries: %s", err)}
+	}
+	return OperationResult{Content: string(encoded), Structured: tree}
+}
+
+// encodeTree returns the tree of the json format of listEntries and its encoding
+func encodeTree(path string, depth int, entries []*treeEntry, more int, truncated bool) (map[string]any, []byte, error) {
+	tree := map[string]any{"path": path, "depth": depth, "entries": entries}
+	if more > 0 {
+		tree["more"] = more
+	}
+	if truncated {
+		tree["truncated"] = true
+	}
+	encoded, err := json.Marshal(tree)
+	return tree, encoded, err
+}
+
+// fitTree keeps as many entries of the tree as fit in maxBytes once encoded, level by level so the
+// deepest entries are the first left out. The entries left out are counted in the more count of their
+// directory.
+func fitTree(path string, depth int, entries []*treeEntry, more int, maxBytes int) (map[string]any, []byte, error) {
+	// rank orders the entries breadth first, the n first entries of this order are kept
+	rank := map[*treeEntry]int{}
+	for level := entries; len(level) > 0; {
+		next := []*treeEntry{}
+		for _, entry := range level {
+			rank[entry] = len(rank)
+			next = append(next, entry.Entries...)
+		}
+		level = next
+	}
+
+	encodeFirst := func(n int) (map[string]any, []byte, error) {
+		kept, dropped := pruneTree(entries, func(entry *treeEntry) bool { return rank[entry] < n })
+		return encodeTree(path, depth, kept, more+dropped, true)
+	}
+	var err error
+	fits := sort.Search(len(rank)+1, func(n int) bool {
+		_, encoded, encodeErr := encodeFirst(n)
+		err = cmp.Or(err, encodeErr)
+		return len(encoded) > maxBytes
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeFirst(max(fits-1, 0))
+}
+
+// pruneTree returns a copy of the entries with only the entries kept, and the number of entries left out
+// at the top level. The entries left out below are counted in the more count of their directory.
+func pruneTree(entries []*treeEntry, keep func(*treeEntry) bool) ([]*treeEntry, int) {
+	pruned := []*treeEntry{}
+	dropped := 0
+	for _, entry := range entries {
+		if !keep(entry) {
+			dropped++
+			continue
+		}
+		clone := *entry
+		var droppedBelow int
+		clone.Entries, droppedBelow = pruneTree(entry.Entries, keep)
+		clone.More += droppedBelow
+		pruned = append(pruned, &clone)
+	}
+	return pruned, dropped
+}
+
+// fileSearch describes the entries searchFiles looks for. Fields left empty match every entry.
+type fileSearch struct {
+	// pattern is a glob matched like the patterns of path rules: against the name of the entry when it
+	// has no slash, and against its path relative to the search directory otherwise
+	pattern string
+	// name is a case-insensitive substring of the name of the entry
+	name string
+	// regex is matched against the path of the entry relative to the search directory
+	regex *regexp.Regexp
+	// entryType is file, directory or symlink
+	entryType      string
+	minSize        int64
+	maxSize        int64
+	modifiedAfter  time.Time
+	modifiedBefore time.Time
+	maxResults     int
+}
+
+const (
+	entryTypeFile      = "file"
+	entryTypeDirectory = "directory"
+	entryTypeSymlink   = "symlink"
+)
+
+func entryType(entry os.DirEntry) string {
+	switch {
+	case entry.Type()&os.ModeSymlink != 0:
+		return entryTypeSymlink
+	case entry.IsDir():
+		return entryTypeDirectory
+	default:
+		return entryTypeFile
+	}
+}
+
+// matches reports whether an entry found by walkTree is one of the entries looked for. Size filters
+// only match files.
+func (s fileSearch) matches(entry walkEntry) bool {
+	if s.entryType != "" && entryType(entry.entry) != s.entryType {
+		return false
+	}
+	if s.pattern != "" && !matchEntryGlob(s.pattern, entry.relPath, entry.entry.Name()) {
+		return false
+	}
+	if s.name != "" && !strings.Contains(strings.ToLower(entry.entry.Name()), strings.ToLower(s.name)) {
+		return false
+	}
+	if s.regex != nil && !s.regex.MatchString(entry.relPath) {
+		return false
+	}
+
+	if !s.needsInfo() {
+		return true
+	}
+	info := entry.info
+	if info == nil {
+		var err error
+		if info, err = entry.entry.Info(); err != nil {
+			return false
+		}
+	}
+	if s.minSize > 0 || s.maxSize > 0 {
+		if !info.Mode().IsRegular() || info.Size() < s.minSize || s.maxSize > 0 && info.Size() > s.maxSize {
+			return false
+		}
+	}
+	if !s.modifiedAfter.IsZero() && !info.ModTime().After(s.modifiedAfter) {
+		return false
+	}
+	if !s.modifiedBefore.IsZero() && !info.ModTime().Before(s.modifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// needsInfo reports whether matching entries needs their FileInfo
+func (s fileSearch) needsInfo() bool {
+	return s.minSize > 0 || s.maxSize > 0 || !s.modifiedAfter.IsZero() || !s.modifiedBefore.IsZero()
+}
+
+// searchFiles walks a directory and everything below it, returning the paths of the entries matching a
+// search, up to search.maxResults of them. Entries left out by the filter are not searched, nor is
+// anything below them, and symlinks to directories are not followed.
+func searchFiles(ctx context.Context, root *fsRoot, path string, search fileSearch, filter entryFilter) OperationResult {
+	info, err, exists := assertPath(root, path)
+	if err != nil {
+		return OperationResult{Error: err}
+	}
+	if !exists {
+		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
+	}
+	if !info.IsDir() {
+		return OperationResult{Message: "path is not a directory"}
+	}
+
+	var results strings.Builder
+	found := 0
+	hasMore := false
+
+	opts := walkOptions{filter: filter, maxDepth: -1, info: search.needsInfo()}
+	err = walkTree(ctx, root, path, opts, func(entry walkEntry) error {
+		if !search.matches(entry) {
+			return nil
+		}
+		if search.maxResults > 0 && found == search.maxResults {
+			hasMore = true
+			return filepath.SkipAll
+		}
+		fmt.Fprintf(&results, "- %s (%s)\n", entry.path, entryType(entry.entry))
+		found++
+		return nil
+	})
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
+	}
+
+	if found == 0 {
+		return OperationResult{Message: fmt.Sprintf("no entries found under %s", path)}
+	}
+	return OperationResult{
+		Content:  results.String(),
+		Metadata: map[string]any{"returned": found, "hasMore": hasMore},
+	}
+}
+
+// maxGrepFileSize is the size above which grepContent skips a file instead of loading it in memory
+const maxGrepFileSize = 16 << 20
+
+// contentSearch describes what grepContent looks for
+type contentSearch struct {
+	regex *regexp.Regexp
+	// include is a glob the names of the files searched must match, such as *.go
+	include      string
+	contextLines int
+	maxResults   int
+}
+
+type grepMatch struct {
+	line   int
+	column int
+}
+
+// grepContent searches the text files at path, or under it when it is a directory, for a regular
+// expression. Each match is returned as "path:line:column: text", with line and column starting at 1 and
+// the column counted in characters, and the lines around it as "path-line- text". Binary files, detected
+// as getFileInfo and readFromFile do, are skipped, as are symlinks and the entries left out by the filter.
+func grepContent(ctx context.Context, root *fsRoot, path string, search contentSearch, filter entryFilter) OperationResult {
+	info, err, exists := assertPath(root, path)
+	if err != nil {
+		return OperationResult{Error: err}
+	}
+	if !exists {
+		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
+	}
+
+	var results strings.Builder
+	found, filesSearched, filesSkipped := 0, 0, 0
+	hasMore := false
+
+	grepFile := func(filePath string, size int64) error {
+		if size > maxGrepFileSize {
+			filesSkipped++
+			return nil
+		}
+		if mimeType, err := getMimeType(root, filePath); err != nil {
+			return err
+		} else if !strings.HasPrefix(mimeType, "text/") {
+			filesSkipped++
+			return nil
+		}
+		content, err := root.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(content) {
+			filesSkipped++
+			return nil
+		}
+		filesSearched++
+
+		lines := splitLines(string(content))
+		matches := map[int][]grepMatch{}
+		shown := make([]bool, len(lines))
+		for i, line := range lines {
+			line = strings.TrimRight(line, "\r\n")
+			for _, loc := range search.regex.FindAllStringIndex(line, -1) {
+				if search.maxResults > 0 && found == search.maxResults {
+					hasMore = true
+					break
+				}
+				matches[i] = append(matches[i], grepMatch{line: i + 1, column: utf8.RuneCountInString(line[:loc[0]]) + 1})
+				found++
+			}
+			if len(matches[i]) > 0 {
+				for j := max(i-search.contextLines, 0); j <= min(i+search.contextLines, len(lines)-1); j++ {
+					shown[j] = true
+				}
+			}
+			if hasMore {
+				break
+			}
+		}
+
+		previous := -1
+		for i, line := range lines {
+			if !shown[i] {
+				continue
+			}
+			if search.contextLines > 0 && results.Len() > 0 && previous != i-1 {
+				results.WriteString("--\n")
+			}
+			previous = i
+			line = strings.TrimRight(line, "\r\n")
+			if len(matches[i]) == 0 {
+				fmt.Fprintf(&results, "%s-%d- %s\n", filePath, i+1, line)
+			}
+			for _, match := range matches[i] {
+				fmt.Fprintf(&results, "%s:%d:%d: %s\n", filePath, match.line, match.column, line)
+			}
+		}
+		return nil
+	}
+
+	if info.IsDir() {
+		opts := walkOptions{filter: filter, maxDepth: -1, info: true}
+		err = walkTree(ctx, root, path, opts, func(entry walkEntry) error {
+			if !entry.entry.Type().IsRegular() || entry.info == nil {
+				return nil
+			}
+			if search.include != "" {
+				if ok, _ := filepath.Match(search.include, entry.entry.Name()); !ok {
+					return nil
+				}
+			}
+			if err := grepFile(entry.path, entry.info.Size()); err != nil {
+				return err
+			}
+			if hasMore {
+				return filepath.SkipAll
+			}
+			return nil
+		})
+	} else {
+		err = grepFile(path, info.Size())
+	}
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error searching the files: %s", err)}
+	}
+
+	metadata := map[string]any{
+		"returned":      found,
+		"hasMore":       hasMore,
+		"filesSearched": filesSearched,
+		"filesSkipped":  filesSkipped,
+	}
+	if found == 0 {
+		return OperationResult{Message: fmt.Sprintf("no matches found in %d files under %s", filesSearched, path)}
+	}
+	return OperationResult{Content: results.String(), Metadata: metadata}
+}
+
+// readFile reads a whole file. A file larger than maxBytes is read as a range from its first line
+// instead, stopping at maxBytes, so it is never held in memory as a whole. A maxBytes of 0 reads any file.
+func readFile(root *fsRoot, path string, maxBytes int64) OperationResult {
+	info, err, exists := assertPath(root, path)
+	if err != nil {
+		return OperationResult{Error: err}
+	}
+	if !exists {
+		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
+	}
+	if info.IsDir() {
+		return OperationResult{Message: "path is a directory, must be a file"}
+	}
+	if maxBytes > 0 && info.Size() > maxBytes {
+		return readFileRange(root, path, readUnitLines, 0, 0, maxBytes)
+	}
+
+	content, err := root.ReadFile(path)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error reading the file: %s", err)}
+	}
+
+	// Check if content is valid UTF-8 text
+	if !utf8.Valid(content) {
+		return OperationResult{Message: "file is not valid UTF-8 text (likely binary)"}
+	}
+
+	return OperationResult{Content: string(content), Metadata: map[string]any{"hash": contentHash(content)}}
+}
+
+// errHashConflict is returned when a file no longer has the content hash a client read earlier
+var errHashConflict = errors.New("conflict: file changed since it was read")
+
+// contentHash returns the hash identifying the content of a file, in the format "sha256:<hex>"
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fileHash returns the content hash of a file without loading it in memory at once
+func fileHash(root *fsRoot, path string) (string, error) {
+	file, err := root.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkFileHash refuses with a conflict error when a file no longer has the content hash expected by the
+// client, because it was changed or removed since the client read it
+func checkFileHash(root *fsRoot, path, expectedHash string) OperationResult {
+	info, err, exists := assertPath(root, path)
+	if err != nil {
+		return OperationResult{Error: err}
+	}
+	if !exists {
+		return OperationResult{Error: fmt.Errorf("%w: %s no longer exists", errHashConflict, path)}
+	}
+	if info.IsDir() {
+		return OperationResult{Message: "expectedHash can only be checked on a file"}
+	}
+
+	hash, err := fileHash(root, path)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error reading the file: %s", err)}
+	}
+	if hash != expectedHash {
+		return OperationResult{Error: fmt.Errorf("%w: %s now has hash %s, expected %s", errHashConflict, path, hash, expectedHash)}
+	}
+	return OperationResult{}
+}
+
+const (
+	readUnitLines = "lines"
+	readUnitBytes = "bytes"
+)
+
+// readFileRange reads part of a file, skipping offset lines or bytes and returning at most limit of them,
+// where a limit of 0 reads up to the end of the file. The file is streamed, so only the returned range is
+// held in memory. The metadata reports the returned range, the total number of lines and whether more
+// content remains, so agents can page through large files.
+//
+// The range is cut once it reaches maxBytes, at the end of a line for the lines unit, and the metadata
+// then tells where to continue from. A maxBytes of 0 returns the whole range.
+func readFileRange(root *fsRoot, path, unit string, offset, limit, maxBytes int64) OperationResult {
+	info, err, exists := assertPath(root, path)
+	if err != nil {
+		return OperationResult{Error: err}
+	}
+	if !exists {
+		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
+	}
+	if info.IsDir() {
+		return OperationResult{Message: "path is a directory, must be a file"}
+	}
+	if unit != readUnitLines && unit != readUnitBytes {
+		return OperationResult{Message: fmt.Sprintf("invalid unit %q, must be lines or bytes", unit)}
+	}
+	if offset < 0 || limit < 0 {
+		return OperationResult{Message: "offset and limit must not be negative"}
+	}
+
+	file, err := root.Open(path)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error reading the file: %s", err)}
+	}
+	defer file.Close()
+
+	inRange := func(position int64) bool {
+		return position >= offset && (limit == 0 || position < offset+limit)
+	}
+
+	content := []byte{}
+	var line, totalBytes int64
+	var lastByte byte
+	// rangeBytes is the size of the whole range, content only holding up to maxBytes of it. For the lines
+	// unit, the lines that fit are counted in fullLines, lineStart is where the line being read starts in
+	// content and lineOffset where it starts in the file. cutLine is set when not even the first line fits.
+	var rangeBytes, fullLines, lineOffset, cutLineOffset int64
+	lineStart := 0
+	full, cutLine := false, false
+	hash := sha256.New()
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := file.Read(buffer)
+		chunk := buffer[:n]
+		hash.Write(chunk)
+		for len(chunk) > 0 {
+			end := len(chunk)
+			newline := bytes.IndexByte(chunk, '\n')
+			if newline >= 0 {
+				end = newline + 1
+			}
+
+			switch {
+			case unit == readUnitLines && inRange(line):
+				rangeBytes += int64(end)
+				if full {
+					break
+				}
+				content = append(content, chunk[:end]...)
+				switch {
+				case maxBytes > 0 && int64(len(content)) > maxBytes:
+					full = true
+					if lineStart > 0 {
+						content = content[:lineStart]
+					} else {
+						content = trimIncompleteRune(content[:maxBytes])
+						cutLine, cutLineOffset = true, lineOffset
+					}
+				case newline >= 0:
+					lineStart = len(content)
+					fullLines++
+				}
+			case unit == readUnitBytes:
+				from := max(offset-totalBytes, 0)
+				to := int64(end)
+				if limit > 0 {
+					to = min(to, offset+limit-totalBytes)
+				}
+				if from < to {
+					rangeBytes += to - from
+					if maxBytes > 0 {
+						to = min(to, from+max(maxBytes-int64(len(content)), 0))
+					}
+					content = append(content, chunk[from:to]...)
+				}
+			}
+
+			if newline >= 0 {
+				line++
+				lineOffset = totalBytes + int64(end)
+			}
+			totalBytes += int64(end)
+			lastByte = chunk[end-1]
+			chunk = chunk[end:]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return OperationResult{Error: fmt.Errorf("error reading the file: %s", err)}
+		}
+	}
+	truncated := int64(len(content)) < rangeBytes
+
+	totalLines := line
+	if totalBytes > 0 && lastByte != '\n' {
+		totalLines++
+	}
+
+	metadata := map[string]any{
+		"unit":       unit,
+		"totalLines": totalLines,
+		"totalBytes": totalBytes,
+		"hash":       "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	var start, returned, total int64
+	if unit == readUnitLines {
+		start, total = offset, totalLines
+		returned = max(totalLines-offset, 0)
+		if limit > 0 {
+			returned = min(returned, limit)
+		}
+		if truncated {
+			returned = fullLines
+		}
+	} else {
+		// Keep whole characters when the range cuts through multi-byte UTF-8 sequences
+		start, total = offset, totalBytes
+		for len(content) > 0 && !utf8.RuneStart(content[0]) {
+			content = content[1:]
+			start++
+		}
+		if truncated || limit > 0 && offset+limit < totalBytes {
+			content = trimIncompleteRune(content)
+		}
+		returned = int64(len(content))
+	}
+
+	// Check if content is valid UTF-8 text
+	if !utf8.Valid(content) {
+		return OperationResult{Message: "file is not valid UTF-8 text (likely binary)"}
+	}
+
+	metadata["offset"] = start
+	metadata["returned"] = returned
+	metadata["hasMore"] = start+returned < total
+	if start+returned < total {
+		metadata["nextOffset"] = start + returned
+	}
+	if truncated {
+		metadata["truncated"] = true
+		metadata["responseBytes"] = int64(len(content))
+		metadata["omittedBytes"] = rangeBytes - int64(len(content))
+		metadata["hint"] = fmt.Sprintf("call readFromFile again with unit=%s and offset=%d to read the rest", unit, start+returned)
+		if cutLine {
+			metadata["hint"] = fmt.Sprintf("line %d is longer than the response limit, call readFromFile with unit=bytes and offset=%d to read it", start, cutLineOffset)
+		}
+	}
+
+	return OperationResult{Content: string(content), Metadata: metadata}
+}
+
+// trimIncompleteRune drops the bytes of a multi-byte UTF-8 sequence cut at the end of data
+func trimIncompleteRune(data []byte) []byte {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return data[:i]
+			}
+			break
+		}
+	}
+	return data
+}
+
+// truncateText cuts text to at most maxSize bytes, at the end of a line when one is found in the second
+// half of the allowed size, and otherwise between two UTF-8 characters
+func truncateText(text string, maxSize int) string {
+	cut := text[:maxSize]
+	if newline := strings.LastIndexByte(cut, '\n'); newline >= maxSize/2 {
+		return cut[:newline+1]
+	}
+	for len(cut) > 0 && !utf8.RuneStart(text[len(cut)]) {
+		cut = cut[:len(cut)-1]
+	}
+	return cut
+}
+
+// writeToFile writes content to a file, creating it and its parent directories when missing. The file
+// gets the given mode when it is set, otherwise an existing file keeps its mode and a new one gets the
+// default mode of perms.
+func writeToFile(root *fsRoot, content, path string, mode os.FileMode, perms filePerms) OperationResult {
+	if root.readOnly {
+		return readOnlyResult(root)
+	}
+
+	dir := filepath.Dir(path)
+
+	if _, err := root.Stat(dir); os.IsNotExist(err) {
+		err = root.MkdirAll(dir, perms.dir)
+		if err != nil {
+			return OperationResult{Error: fmt.Errorf("could not create directory: %s", err)}
+		}
+	}
+
+	perm := perms.file
+	info, err := root.Stat(path)
+	if err == nil && info.IsDir() {
+		return OperationResult{Message: "path is a directory, must be a file"}
+	}
+	if err == nil {
+		perm = info.Mode().Perm()
+	}
+	if mode != 0 {
+		perm = mode
+	}
+
+	err = root.WriteFileAtomic(path, []byte(content), perm)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("could not write to file: %s", err)}
+	}
+
+	return OperationResult{Content: "file written successfully"}
+}
+
+// appendToFile appends content at the end of a file opened with O_APPEND, so concurrent appends are not
+// lost, creating the file and its parent directories when missing. With ensureNewline set, the content
+// starts on a new line and ends with a line break.
+func appendToFile(root *fsRoot, content, path string, ensureNewline bool, perms filePerms) OperationResult {
+	if root.readOnly {
+		return readOnlyResult(root)
+	}
+
+	dir := filepath.Dir(path)
+
+	if _, err := root.Stat(dir); os.IsNotExist(err) {
+		err = root.MkdirAll(dir, perms.dir)
+		if err != nil {
+			return OperationResult{Error: fmt.Errorf("could not create directory: %s", err)}
+		}
+	}
+
+	info, err := root.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return OperationResult{Error: fmt.Errorf("could not read file: %s", err)}
+	}
+	if err == nil && info.IsDir() {
+		return OperationResult{Message: "path is a directory, must be a file"}
+	}
+	created := os.IsNotExist(err)
+
+	if ensureNewline {
+		if !created && info.Size() > 0 {
+			last := make([]byte, 1)
+			file, err := root.Open(path)
+			if err != nil {
+				return OperationResult{Error: fmt.Errorf("could not read file: %s", err)}
+			}
+			_, err = file.ReadAt(last, info.Size()-1)
+			file.Close()
+			if err != nil {
+				return OperationResult{Error: fmt.Errorf("could not read file: %s", err)}
+			}
+			if last[0] != '\n' {
+				content = "\n" + content
+			}
+		}
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+	}
+
+	file, err := root.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perms.file)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("could not open file: %s", err)}
+	}
+	defer file.Close()
+
+	if created {
+		if err := file.Chmod(perms.file); err != nil {
+			return OperationResult{Error: fmt.Errorf("could not set file mode: %s", err)}
+		}
+	}
+	n, err := file.WriteString(content)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("could not append to file: %s", err)}
+	}
+	if err := file.Close(); err != nil {
+		return OperationResult{Error: fmt.Errorf("could not append to file: %s", err)}
+	}
+
+	return OperationResult{Content: fmt.Sprintf("appended %d bytes to %s", n, path)}
+}
+
+// readTextLines reads a file that must be UTF-8 text, split into lines that keep their line endings. The
+// result is only set when the file cannot be read as text.
+func readTextLines(root *fsRoot, path string) ([]string, os.FileMode, OperationResult) {
+	info, err, exists := assertPath(root, path)
+	if err != nil {
+		return nil, 0, OperationResult{Error: err}
+	}
+	if !exists {
+		return nil, 0, OperationResult{Message: fmt.Sprintf("file not found at %s", path)}
+	}
+	if info.IsDir() {
+		return nil, 0, OperationResult{Message: "path is a directory, must be a file"}
+	}
+
+	content, err := root.ReadFile(path)
+	if err != nil {
+		return nil, 0, OperationResult{Error: fmt.Errorf("error reading the file: %s", err)}
+	}
+	if !utf8.Valid(content) {
+		return nil, 0, OperationResult{Message: "file is not valid UTF-8 text (likely binary)"}
+	}
+	return splitLines(string(content)), info.Mode().Perm(), OperationResult{}
+}
+
+// numberedLines returns the lines from first to last, both 1-based and inclusive, along with diffContext
+// lines around them, each prefixed with its line number
+func numberedLines(lines []string, first, last int) string {
+	var b strings.Builder
+	for i := max(first-diffContext, 1); i <= min(last+diffContext, len(lines)); i++ {
+		fmt.Fprintf(&b, "%d: %s", i, strings.TrimSuffix(lines[i-1], "\n")+"\n")
+	}
+	return b.String()
+}
+
+// insertLines inserts content after a 1-based line of a file, or at its start when line is 0, and writes
+// the file atomically. The content is the inserted lines with the lines around them.
+func insertLines(root *fsRoot, path string, line int, content string) OperationResult {
+	if root.readOnly {
+		return readOnlyResult(root)
+	}
+	if content == "" {
+		return OperationResult{Message: "content must not be empty"}
+	}
+	if !utf8.ValidString(content) {
+		return OperationResult{Message: "content is not valid UTF-8 text"}
+	}
+
+	lines, mode, result := readTextLines(root, path)
+	if result.Error != nil || result.Message != "" {
+		return result
+	}
+	if line < 0 || line > len(lines) {
+		return OperationResult{Message: fmt.Sprintf("line %d is out of range, the file has %d lines", line, len(lines))}
+	}
+
+	// Keep the inserted lines separate from the ones around them
+	if line > 0 && !strings.HasSuffix(lines[line-1], "\n") {
+		lines[line-1] += "\n"
+	}
+	if line < len(lines) && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	inserted := splitLines(content)
+	lines = slices.Insert(lines, line, inserted...)
+
+	if err := root.WriteFileAtomic(path, []byte(strings.Join(lines, "")), mode); err != nil {
+		return OperationResult{Error: fmt.Errorf("could not write to file: %s", err)}
+	}
+
+	return OperationResult{Content: fmt.Sprintf(
+		"inserted %d lines after line %d, lines around them are now:\n%s",
+		len(inserted), line, numberedLines(lines, line+1, line+len(inserted)),
+	)}
 }
 
-func listEntries(path string, depth float64, prefix string) OperationResult {
-	info, err, exists := assertPath(path)
-	if err != nil {
-		return OperationResult{Error: err}
+// deleteLines deletes the lines from first to last, both 1-based and inclusive, and writes the file
+// atomically. The content is the lines around the deleted ones.
+func deleteLines(root *fsRoot, path string, first, last int) OperationResult {
+	if root.readOnly {
+		return readOnlyResult(root)
 	}
-	if !exists {
-		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
+
+	lines, mode, result := readTextLines(root, path)
+	if result.Error != nil || result.Message != "" {
+		return result
 	}
-	if !info.IsDir() {
-		return OperationResult{Message: "path is not a directory"}
+	if first < 1 || last < first || last > len(lines) {
+		return OperationResult{Message: fmt.Sprintf(
+			"lines %d to %d are out of range, the file has %d lines", first, last, len(lines),
+		)}
 	}
 
-	entries, err := os.ReadDir(path)
-	if err != nil {
-		return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
-	}
+	lines = slices.Delete(lines, first-1, last)
 
-	allEntries := ""
-	for _, entry := range entries {
-		entryPath := filepath.Join(path, entry.Name())
-		pathType := "file"
-		if entry.IsDir() {
-			pathType = "directory"
-		}
-		allEntries += fmt.Sprintf("%s- %s (%s)\n", prefix, entry.Name(), pathType)
-		if entry.IsDir() && depth != 0 {
-			operationResult := listEntries(entryPath, depth-1, prefix+"  ")
-			if operationResult.Error != nil {
-				return OperationResult{Error: fmt.Errorf("error reading subDirectory: %s", err)}
-			}
-			allEntries += operationResult.Content
-		}
+	if err := root.WriteFileAtomic(path, []byte(strings.Join(lines, "")), mode); err != nil {
+		return OperationResult{Error: fmt.Errorf("could not write to file: %s", err)}
 	}
-	return OperationResult{Content: allEntries}
+
+	// The lines around the deletion are the one before it and the one now at its place
+	return OperationResult{Content: fmt.Sprintf(
+		"deleted lines %d to %d, lines around them are now:\n%s",
+		first, last, numberedLines(lines, first, first-1),
+	)}
 }
 
-func readFile(path string) OperationResult {
-	info, err, exists := assertPath(path)
+// textEdit replaces oldText with newText in a file. oldText must appear exactly once, unless replaceAll
+// is set, in which case every occurrence is replaced.
+type textEdit struct {
+	oldText    string
+	newText    string
+	replaceAll bool
+}
+
+// editFile applies edits to a file in order, each one seeing the result of the previous ones, and writes
+// the result atomically. Nothing is written when any edit fails. The content is a unified diff of the
+// changes.
+func editFile(root *fsRoot, path string, edits []textEdit) OperationResult {
+	if root.readOnly {
+		return readOnlyResult(root)
+	}
+	if len(edits) == 0 {
+		return OperationResult{Message: "no edits given"}
+	}
+
+	info, err, exists := assertPath(root, path)
 	if err != nil {
 		return OperationResult{Error: err}
 	}
 	if !exists {
-		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
+		return OperationResult{Message: fmt.Sprintf("file not found at %s", path)}
 	}
 	if info.IsDir() {
 		return OperationResult{Message: "path is a directory, must be a file"}
 	}
 
-	content, err := os.ReadFile(path) // #nosec G304
+	data, err := root.ReadFile(path)
 	if err != nil {
-		return OperationResult{Error: fmt.Errorf("error reading the file: %s", err)}
+		return OperationResult{Error: fmt.Errorf("could not read file: %s", err)}
 	}
+	original := string(data)
 
-	// Check if content is valid UTF-8 text
-	if !utf8.Valid(content) {
-		return OperationResult{Message: "file is not valid UTF-8 text (likely binary)"}
+	content := original
+	for i, edit := range edits {
+		if edit.oldText == "" {
+			return OperationResult{Message: fmt.Sprintf("edit %d: oldText must not be empty", i+1)}
+		}
+		switch count := strings.Count(content, edit.oldText); {
+		case count == 0:
+			return OperationResult{Message: fmt.Sprintf("edit %d: oldText not found in %s", i+1, path)}
+		case count > 1 && !edit.replaceAll:
+			return OperationResult{Message: fmt.Sprintf(
+				"edit %d: oldText found %d times in %s, add surrounding lines to make it unique or set replaceAll", i+1, count, path,
+			)}
+		}
+		content = strings.ReplaceAll(content, edit.oldText, edit.newText)
 	}
 
-	return OperationResult{Content: string(content)}
+	diff := unifiedDiff(path, path, original, content)
+	if diff == "" {
+		return OperationResult{Content: "no changes made, the file already has this content"}
+	}
+
+	if err := root.WriteFileAtomic(path, []byte(content), info.Mode().Perm()); err != nil {
+		return OperationResult{Error: fmt.Errorf("could not write to file: %s", err)}
+	}
+
+	return OperationResult{Content: diff}
 }
 
-func writeToFile(content, path string) OperationResult {
-	dir := filepath.Dir(path)
+// patchTarget is a file changed by a patch, with the paths its names resolve to. oldPath is empty when
+// the file is created and newPath is empty when it is deleted.
+type patchTarget struct {
+	patch   filePatch
+	root    *fsRoot
+	oldPath string
+	newPath string
+}
 
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		err = os.MkdirAll(dir, 0750)
-		if err != nil {
-			return OperationResult{Error: fmt.Errorf("could not create directory: %s", err)}
+// applyPatch applies a patch to every file it changes, or to none of them: the hunks of all the files
+// are applied in memory first, and the files are only written when every hunk applies. When writing a
+// file fails, the files already written are restored. Created files and directories get the default
+// modes of perms.
+func applyPatch(targets []patchTarget, perms filePerms) OperationResult {
+	type patchedFile struct {
+		target   patchTarget
+		original []byte
+		content  string
+		mode     os.FileMode
+	}
+
+	patched := []patchedFile{}
+	rejections := []string{}
+	notes := []string{}
+	for _, target := range targets {
+		if target.root.readOnly {
+			return readOnlyResult(target.root)
+		}
+		name := target.patch.displayName()
+
+		file := patchedFile{target: target, mode: perms.file}
+		if target.oldPath != "" {
+			info, err, exists := assertPath(target.root, target.oldPath)
+			if err != nil {
+				return OperationResult{Error: err}
+			}
+			if !exists {
+				rejections = append(rejections, fmt.Sprintf("%s: file not found at %s", name, target.oldPath))
+				continue
+			}
+			if info.IsDir() {
+				rejections = append(rejections, fmt.Sprintf("%s: path is a directory, must be a file", name))
+				continue
+			}
+			file.mode = info.Mode().Perm()
+			file.original, err = target.root.ReadFile(target.oldPath)
+			if err != nil {
+				return OperationResult{Error: fmt.Errorf("could not read file: %s", err)}
+			}
+		}
+		if target.newPath != "" && target.newPath != target.oldPath {
+			if _, err := target.root.Lstat(target.newPath); err == nil {
+				rejections = append(rejections, fmt.Sprintf("%s: file already exists at %s", name, target.newPath))
+				continue
+			}
+		}
+
+		content, fileNotes, fileRejections := applyHunks(string(file.original), target.patch.hunks)
+		for _, rejection := range fileRejections {
+			rejections = append(rejections, fmt.Sprintf("%s: %s", name, rejection))
+		}
+		for _, note := range fileNotes {
+			notes = append(notes, fmt.Sprintf("%s: %s", name, note))
 		}
+		if target.newPath == "" && content != "" && len(fileRejections) == 0 {
+			rejections = append(rejections, fmt.Sprintf("%s: file is deleted by the patch but has content the patch does not remove", name))
+		}
+		file.content = content
+		patched = append(patched, file)
 	}
 
-	info, err := os.Stat(path)
-	if err == nil && info.IsDir() {
-		return OperationResult{Message: "path is a directory, must be a file"}
+	if len(rejections) > 0 {
+		return OperationResult{Message: "patch not applied, no file was changed:\n- " + strings.Join(rejections, "\n- ")}
 	}
 
-	err = os.WriteFile(path, []byte(content), 0600)
-	if err != nil {
-		return OperationResult{Error: fmt.Errorf("could not write to file: %s", err)}
+	// Undo the changes made so far when a file cannot be written
+	undo := []func(){}
+	rollback := func(err error) OperationResult {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return OperationResult{Error: fmt.Errorf("could not apply patch, changed files were restored: %s", err)}
 	}
 
-	return OperationResult{Content: "file written successfully"}
+	summary := []string{}
+	for _, file := range patched {
+		target := file.target
+		if target.newPath != "" {
+			if err := target.root.MkdirAll(filepath.Dir(target.newPath), perms.dir); err != nil {
+				return rollback(err)
+			}
+			if err := target.root.WriteFileAtomic(target.newPath, []byte(file.content), file.mode); err != nil {
+				return rollback(err)
+			}
+			if target.newPath == target.oldPath {
+				undo = append(undo, func() { _ = target.root.WriteFileAtomic(target.oldPath, file.original, file.mode) })
+			} else {
+				undo = append(undo, func() { _ = target.root.Remove(target.newPath) })
+			}
+		}
+		if target.oldPath != "" && target.oldPath != target.newPath {
+			if err := target.root.Remove(target.oldPath); err != nil {
+				return rollback(err)
+			}
+			undo = append(undo, func() { _ = target.root.WriteFileAtomic(target.oldPath, file.original, file.mode) })
+		}
+
+		switch {
+		case target.oldPath == "":
+			summary = append(summary, fmt.Sprintf("created %s", target.newPath))
+		case target.newPath == "":
+			summary = append(summary, fmt.Sprintf("deleted %s", target.oldPath))
+		case target.oldPath != target.newPath:
+			summary = append(summary, fmt.Sprintf("renamed %s to %s", target.oldPath, target.newPath))
+		default:
+			summary = append(summary, fmt.Sprintf("patched %s", target.newPath))
+		}
+	}
+
+	content := "patch applied:\n- " + strings.Join(summary, "\n- ")
+	if len(notes) > 0 {
+		content += "\nnotes:\n- " + strings.Join(notes, "\n- ")
+	}
+	return OperationResult{Content: content}
 }
 
-func getFileInfo(path string) OperationResult {
-	info, err, exists := assertPath(path)
+// getFileInfo describes a file, or a directory. For a directory it counts the entries kept by the filter
+// and, with aggregate, measures everything below it, which means walking the whole tree.
+func getFileInfo(ctx context.Context, root *fsRoot, path string, aggregate bool, filter entryFilter) OperationResult {
+	info, err, exists := assertPath(root, path)
 	if err != nil {
 		return OperationResult{Error: err}
 	}
@@ -135,14 +1673,19 @@ func getFileInfo(path string) OperationResult {
 		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
 	}
 	if info.IsDir() {
-		return OperationResult{Message: "path is a directory, must be a file"}
+		return getDirectoryInfo(ctx, root, path, info, aggregate, filter)
 	}
 
-	mimetype, err := getMimeType(path)
+	mimetype, err := getMimeType(root, path)
 	if err != nil {
 		return OperationResult{Error: err}
 	}
 
+	hash, err := fileHash(root, path)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error reading the file: %s", err)}
+	}
+
 	perms := info.Mode().String()
 	modTime := info.ModTime().Format(time.RFC3339)
 
@@ -151,37 +1694,108 @@ func getFileInfo(path string) OperationResult {
 			"Size: %d bytes\n"+
 			"Permissions: %s\n"+
 			"Last Modified: %s\n"+
-			"MIME Type: %s\n",
+			"MIME Type: %s\n"+
+			"Hash: %s\n",
 		path,
 		info.Size(),
 		perms,
 		modTime,
 		mimetype,
+		hash,
 	)
 
 	return OperationResult{Content: fileInfo}
 }
 
-func getMimeType(path string) (string, error) {
-	file, err := os.Open(path) // #nosec G304
+func getDirectoryInfo(ctx context.Context, root *fsRoot, path string, info os.FileInfo, aggregate bool, filter entryFilter) OperationResult {
+	entries, err := root.ReadDir(path)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
+	}
+	count := 0
+	for _, entry := range entries {
+		if filter == nil || filter(filepath.Join(path, entry.Name()), entry) {
+			count++
+		}
+	}
+
+	var dirInfo strings.Builder
+	fmt.Fprintf(&dirInfo,
+		"Directory: %s\n"+
+			"Entries: %d\n"+
+			"Permissions: %s\n"+
+			"Last Modified: %s\n",
+		path,
+		count,
+		info.Mode().String(),
+		info.ModTime().Format(time.RFC3339),
+	)
+	if !aggregate {
+		return OperationResult{Content: dirInfo.String()}
+	}
+
+	usage, err := measureTree(ctx, root, path, filter)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
+	}
+
+	extensions := slices.Collect(maps.Keys(usage.extensions))
+	slices.SortFunc(extensions, func(a, b string) int {
+		return cmp.Or(cmp.Compare(usage.extensions[b], usage.extensions[a]), strings.Compare(a, b))
+	})
+	counts := make([]string, 0, len(extensions))
+	for _, extension := range extensions {
+		name := extension
+		if name == "" {
+			name = "no extension"
+		}
+		counts = append(counts, fmt.Sprintf("%s %d", name, usage.extensions[extension]))
+	}
+
+	fmt.Fprintf(&dirInfo,
+		"Total Size: %d bytes\n"+
+			"Files: %d\n"+
+			"Directories: %d\n"+
+			"Files by Extension: %s\n",
+		usage.size,
+		usage.files,
+		usage.directories,
+		strings.Join(counts, ", "),
+	)
+	if usage.newest != "" {
+		fmt.Fprintf(&dirInfo, "Newest File: %s (%s)\n", usage.newest, usage.newestTime.Format(time.RFC3339))
+		fmt.Fprintf(&dirInfo, "Oldest File: %s (%s)\n", usage.oldest, usage.oldestTime.Format(time.RFC3339))
+	}
+	return OperationResult{Content: dirInfo.String()}
+}
+
+func getMimeType(root *fsRoot, path string) (string, error) {
+	file, err := root.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	// Read the first 512 bytes for MIME detection
+	// Read the first 512 bytes for MIME detection, only what was read is looked at so the zero padding
+	// of a smaller file does not make it look binary
 	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
-	if err != nil {
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return "", err
 	}
 
-	mimeType := http.DetectContentType(buffer)
+	mimeType := http.DetectContentType(buffer[:n])
 	return mimeType, nil
 }
 
-func renamePath(path, newName string) OperationResult {
-	_, err, exists := assertPath(path)
+// renamePath gives a new name to a file or directory, as long as the movable filter lets it and every
+// entry below it be moved to the new path
+func renamePath(ctx context.Context, root *fsRoot, path, newName string, movable entryFilter) OperationResult {
+	if root.readOnly {
+		return readOnlyResult(root)
+	}
+
+	info, err, exists := assertPath(root, path)
 	if err != nil {
 		return OperationResult{Error: err}
 	}
@@ -190,15 +1804,23 @@ func renamePath(path, newName string) OperationResult {
 		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
 	}
 
+	denied, err := deniedMove(ctx, root, path, info, movable)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
+	}
+	if denied != "" {
+		return OperationResult{Message: fmt.Sprintf("cannot rename %s, %s is protected by path rules", path, denied)}
+	}
+
 	fileDir := filepath.Dir(path)
 	newPathName := filepath.Join(fileDir, newName)
 
 	// Check if new name already exists
-	if _, err := os.Stat(newPathName); err == nil {
+	if _, err := root.Lstat(newPathName); err == nil {
 		return OperationResult{Message: fmt.Sprintf("target path %s already exists", newPathName)}
 	}
 
-	err = os.Rename(path, newPathName)
+	err = root.Rename(path, newPathName)
 	if err != nil {
 		return OperationResult{Error: err}
 	}
@@ -206,8 +1828,19 @@ func renamePath(path, newName string) OperationResult {
 	return OperationResult{Content: newPathName}
 }
 
-func copyFileOrDir(path, dst string) OperationResult {
-	fileInfo, err, exists := assertPath(path)
+// copyFileOrDir copies a file or directory to dst. The missing parent directories of dst are created
+// with the configured mode, while the copied directories keep the mode of their source. Entries left out
+// by filter are not copied, and the copy of a directory is refused when writable leaves out any of the
+// paths it would write.
+func copyFileOrDir(
+	ctx context.Context, root *fsRoot, path string, dstRoot *fsRoot, dst string,
+	filter, writable entryFilter, perms filePerms,
+) OperationResult {
+	if dstRoot.readOnly {
+		return readOnlyResult(dstRoot)
+	}
+
+	fileInfo, err, exists := assertPath(root, path)
 	if err != nil {
 		return OperationResult{Error: err}
 	}
@@ -215,25 +1848,60 @@ func copyFileOrDir(path, dst string) OperationResult {
 		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
 	}
 
+	if fileInfo.IsDir() && writable != nil {
+		// The copy merges into an existing directory, so every path it writes has to be checked
+		dstPath := func(entryPath string) string {
+			rel, _ := filepath.Rel(path, entryPath)
+			return filepath.Join(dst, rel)
+		}
+		denied, err := deniedEntry(ctx, root, path, func(entryPath string, entry os.DirEntry) bool {
+			if filter != nil && !filter(entryPath, entry) {
+				return true
+			}
+			return writable(dstPath(entryPath), entry)
+		})
+		if err != nil {
+			return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
+		}
+		if denied != "" {
+			return OperationResult{Message: fmt.Sprintf("cannot copy %s to %s, %s is protected by path rules", path, dst, dstPath(denied))}
+		}
+	}
+
+	if err := dstRoot.MkdirAll(filepath.Dir(dst), perms.dir); err != nil {
+		return OperationResult{Error: fmt.Errorf("could not create directory: %s", err)}
+	}
+
 	if fileInfo.IsDir() {
-		return copyDir(path, dst)
+		return copyDir(root, path, dstRoot, dst, filter, perms)
 	}
-	return copyFile(path, dst)
+	return copyFile(root, path, dstRoot, dst, perms)
 }
 
-func copyFile(path, destination string) OperationResult {
-	sourceFile, err := os.Open(path)
+// copyFile copies a file to destination. A new destination gets the default file mode of perms, while an
+// existing one keeps its mode.
+func copyFile(root *fsRoot, path string, dstRoot *fsRoot, destination string, perms filePerms) OperationResult {
+	sourceFile, err := root.Open(path)
 	if err != nil {
 		return OperationResult{Error: err}
 	}
 	defer sourceFile.Close()
 
-	destFile, err := os.Create(destination)
+	_, err = dstRoot.Lstat(destination)
+	created := os.IsNotExist(err)
+	destFile, err := dstRoot.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perms.file)
 	if err != nil {
 		return OperationResult{Error: err}
 	}
 	defer destFile.Close()
 
+	// The mode given to open is masked by the umask, so set it explicitly
+	if created {
+		if err := destFile.Chmod(perms.file); err != nil {
+			return OperationResult{Error: err}
+		}
+	}
+
 	_, err = io.Copy(destFile, sourceFile)
 	if err != nil {
 		return OperationResult{Error: err}
@@ -247,18 +1915,18 @@ func copyFile(path, destination string) OperationResult {
 	return OperationResult{Content: "File copied to destination"}
 }
 
-func copyDir(path, dst string) OperationResult {
-	pathInfo, err := os.Stat(path)
+func copyDir(root *fsRoot, path string, dstRoot *fsRoot, dst string, filter entryFilter, perms filePerms) OperationResult {
+	pathInfo, err := root.Stat(path)
 	if err != nil {
 		return OperationResult{Error: err}
 	}
 
 	// Create the destination directory
-	if err := os.MkdirAll(dst, pathInfo.Mode()); err != nil {
+	if err := dstRoot.MkdirAll(dst, pathInfo.Mode().Perm()); err != nil {
 		return OperationResult{Error: err}
 	}
 
-	entries, err := os.ReadDir(path)
+	entries, err := root.ReadDir(path)
 	if err != nil {
 		return OperationResult{Error: err}
 	}
@@ -266,13 +1934,16 @@ func copyDir(path, dst string) OperationResult {
 	for _, entry := range entries {
 		srcPath := filepath.Join(path, entry.Name())
 		dstPath := filepath.Join(dst, entry.Name())
+		if filter != nil && !filter(srcPath, entry) {
+			continue
+		}
 
 		if entry.IsDir() {
-			if operationResult := copyDir(srcPath, dstPath); operationResult.Error != nil {
+			if operationResult := copyDir(root, srcPath, dstRoot, dstPath, filter, perms); operationResult.Error != nil {
 				return operationResult
 			}
 		} else {
-			if operationResult := copyFile(srcPath, dstPath); operationResult.Error != nil {
+			if operationResult := copyFile(root, srcPath, dstRoot, dstPath, perms); operationResult.Error != nil {
 				return operationResult
 			}
 		}
@@ -280,3 +1951,320 @@ func copyDir(path, dst string) OperationResult {
 
 	return OperationResult{Error: err}
 }
+
+// trashDirName is the directory, inside each root, where deleted paths are moved to when trash is enabled
+const trashDirName = ".fsmcp-trash"
+
+// deletePath removes a file, or a directory when recursive is set. With trash enabled the path is moved
+// into the trash directory of its root instead, under a timestamped directory that keeps its original
+// relative path so it can be restored later. Paths already in the trash are removed for good. Moving to
+// the trash is checked with the filter trashable returns for the trash path, like a move.
+func deletePath(
+	ctx context.Context, root *fsRoot, path string, recursive, trash bool,
+	writable entryFilter, trashable func(trashPath string) entryFilter, perms filePerms,
+) OperationResult {
+	if root.readOnly {
+		return readOnlyResult(root)
+	}
+
+	info, err := root.Lstat(path)
+	if os.IsNotExist(err) {
+		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
+	}
+	if err != nil {
+		return OperationResult{Error: err}
+	}
+
+	relPath, err := root.rel(path)
+	if err != nil {
+		return OperationResult{Error: err}
+	}
+	if relPath == "." {
+		return OperationResult{Message: "cannot delete the root directory"}
+	}
+	if info.IsDir() && !recursive {
+		return OperationResult{Message: "path is a directory, set recursive to delete it"}
+	}
+	if info.IsDir() {
+		denied, err := deniedEntry(ctx, root, path, writable)
+		if err != nil {
+			return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
+		}
+		if denied != "" {
+			return OperationResult{Message: fmt.Sprintf("cannot delete %s, %s below it is protected by path rules", path, denied)}
+		}
+	}
+
+	trashDir := filepath.Join(root.dir, trashDirName)
+	if trash && !isWithin(trashDir, filepath.Join(root.dir, relPath)) {
+		trashPath := filepath.Join(trashDir, time.Now().Format("20060102T150405.000000000"), relPath)
+		if trashable != nil {
+			denied, err := deniedMove(ctx, root, path, info, trashable(trashPath))
+			if err != nil {
+				return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
+			}
+			if denied != "" {
+				return OperationResult{Message: fmt.Sprintf("cannot move %s to the trash, %s is protected by path rules", path, denied)}
+			}
+		}
+		if err := root.MkdirAll(filepath.Dir(trashPath), perms.dir); err != nil {
+			return OperationResult{Error: fmt.Errorf("could not create trash directory: %s", err)}
+		}
+		if err := root.Rename(path, trashPath); err != nil {
+			return OperationResult{Error: err}
+		}
+		return OperationResult{Content: fmt.Sprintf("path moved to trash at %s", trashPath)}
+	}
+
+	if info.IsDir() {
+		err = root.RemoveAll(path)
+	} else {
+		err = root.Remove(path)
+	}
+	if err != nil {
+		return OperationResult{Error: err}
+	}
+
+	return OperationResult{Content: "path deleted successfully"}
+}
+
+// movePath moves a path to a destination that can be in another directory or root. When the destination
+// exists it is only replaced with overwrite set, and only by a path of the same type. Moves across
+// roots, or across file systems inside a root, fall back to copying the path and then deleting it.
+func movePath(
+	ctx context.Context, root *fsRoot, path string, dstRoot *fsRoot, dst string, overwrite bool,
+	movable, writable entryFilter, perms filePerms,
+) OperationResult {
+	if root.readOnly {
+		return readOnlyResult(root)
+	}
+	if dstRoot.readOnly {
+		return readOnlyResult(dstRoot)
+	}
+
+	info, err := root.Lstat(path)
+	if os.IsNotExist(err) {
+		return OperationResult{Message: fmt.Sprintf("path not found at %s", path)}
+	}
+	if err != nil {
+		return OperationResult{Error: err}
+	}
+	if relPath, err := root.rel(path); err == nil && relPath == "." {
+		return OperationResult{Message: "cannot move the root directory"}
+	}
+
+	absPath, _ := filepath.Abs(path)
+	absDst, _ := filepath.Abs(dst)
+	if root == dstRoot && isWithin(absPath, absDst) {
+		return OperationResult{Message: fmt.Sprintf("cannot move %s to itself or inside itself", path)}
+	}
+
+	dstInfo, err := dstRoot.Lstat(dst)
+	replacing := err == nil
+	if replacing {
+		if !overwrite {
+			return OperationResult{Message: fmt.Sprintf("target path %s already exists", dst)}
+		}
+		if dstInfo.IsDir() != info.IsDir() {
+			return OperationResult{Message: fmt.Sprintf("target path %s already exists with a different type", dst)}
+		}
+		if root == dstRoot && isWithin(absDst, absPath) {
+			return OperationResult{Message: "cannot overwrite a directory containing the path to move"}
+		}
+		if dstInfo.IsDir() {
+			denied, err := deniedEntry(ctx, dstRoot, dst, writable)
+			if err != nil {
+				return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
+			}
+			if denied != "" {
+				return OperationResult{Message: fmt.Sprintf("cannot overwrite %s, %s below it is protected by path rules", dst, denied)}
+			}
+		}
+	}
+
+	denied, err := deniedMove(ctx, root, path, info, movable)
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("error reading the directory: %s", err)}
+	}
+	if denied != "" {
+		return OperationResult{Message: fmt.Sprintf("cannot move %s, %s is protected by path rules", path, denied)}
+	}
+
+	if err := dstRoot.MkdirAll(filepath.Dir(dst), perms.dir); err != nil {
+		return OperationResult{Error: fmt.Errorf("could not create directory: %s", err)}
+	}
+
+	// A file is replaced atomically by the rename, but rename cannot replace a directory that is not
+	// empty. The old directory is moved aside instead, and put back if the move fails.
+	aside := ""
+	if replacing && dstInfo.IsDir() {
+		aside = hiddenSibling(dst, "old")
+		if err := dstRoot.Rename(dst, aside); err != nil {
+			return OperationResult{Error: fmt.Errorf("could not replace the destination: %s", err)}
+		}
+	}
+
+	copied, err := moveEntry(ctx, root, path, dstRoot, dst)
+	if err != nil {
+		if aside != "" {
+			if restoreErr := dstRoot.Rename(aside, dst); restoreErr != nil {
+				return OperationResult{Error: fmt.Errorf("%s, and the replaced directory could not be restored from %s: %s", err, aside, restoreErr)}
+			}
+		}
+		return OperationResult{Error: err}
+	}
+
+	if aside != "" {
+		if err := dstRoot.RemoveAll(aside); err != nil {
+			return OperationResult{Error: fmt.Errorf("path moved to %s but could not delete the replaced directory at %s: %s", dst, aside, err)}
+		}
+	}
+	if copied {
+		if err := root.RemoveAll(path); err != nil {
+			return OperationResult{Error: fmt.Errorf("path copied to %s but could not delete the source: %s", dst, err)}
+		}
+	}
+
+	return OperationResult{Content: dst}
+}
+
+// moveEntry renames path to dst, or copies it when they are on different devices or roots, reporting
+// whether it did copy. A copy is made at a hidden path next to dst, and only renamed to dst once it is
+// complete, so a failed copy never leaves a partial dst behind.
+func moveEntry(ctx context.Context, root *fsRoot, path string, dstRoot *fsRoot, dst string) (bool, error) {
+	if root == dstRoot {
+		err := root.Rename(path, dst)
+		if err == nil || !errors.Is(err, syscall.EXDEV) {
+			return false, err
+		}
+	}
+
+	tmp := hiddenSibling(dst, "tmp")
+	err := copyForMove(ctx, root, path, dstRoot, tmp)
+	if err == nil {
+		err = dstRoot.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = dstRoot.RemoveAll(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+// copyForMove copies path to dst the way a rename would leave it: symlinks are recreated instead of
+// followed, and every entry keeps the permission bits of its source whatever the umask
+func copyForMove(ctx context.Context, root *fsRoot, path string, dstRoot *fsRoot, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	info, err := root.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := root.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return dstRoot.Symlink(target, dst)
+	case info.IsDir():
+		if err := dstRoot.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+		entries, err := root.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyForMove(ctx, root, filepath.Join(path, entry.Name()), dstRoot, filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		if err := copyFileContent(root, path, dstRoot, dst); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot move %s, only files, directories and symlinks can be moved across file systems", path)
+	}
+
+	// The mode is set once the entries of a directory are written, as it may not let them be written
+	return dstRoot.Chmod(dst, info.Mode().Perm())
+}
+
+// copyFileContent copies the content of a file to a new file at dst, which only its owner can access until
+// the caller sets its mode
+func copyFileContent(root *fsRoot, path string, dstRoot *fsRoot, dst string) error {
+	source, err := root.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := dstRoot.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destination, source); err != nil {
+		destination.Close()
+		return err
+	}
+	if err := destination.Sync(); err != nil {
+		destination.Close()
+		return err
+	}
+	return destination.Close()
+}
+
+// filePerms are the default permission bits of the files and directories created by the server
+type filePerms struct {
+	file os.FileMode
+	dir  os.FileMode
+}
+
+var defaultFilePerms = filePerms{file: 0600, dir: 0750}
+
+// parseFileMode parses permission bits given in octal, such as "755" or "0644"
+func parseFileMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q, use octal permission bits such as 0755", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// createDirectory creates a directory with the given permission bits. With parents set, missing parent
+// directories are created as well.
+func createDirectory(root *fsRoot, path string, parents bool, mode os.FileMode) OperationResult {
+	if root.readOnly {
+		return readOnlyResult(root)
+	}
+
+	if info, err := root.Stat(path); err == nil {
+		if info.IsDir() {
+			return OperationResult{Message: fmt.Sprintf("directory already exists at %s", path)}
+		}
+		return OperationResult{Message: fmt.Sprintf("path already exists at %s and is not a directory", path)}
+	}
+
+	if !parents {
+		parent := filepath.Dir(path)
+		if _, err, exists := assertPath(root, parent); err == nil && !exists {
+			return OperationResult{Message: fmt.Sprintf("parent directory not found at %s, set parents to create it", parent)}
+		}
+	}
+
+	var err error
+	if parents {
+		err = root.MkdirAll(path, mode)
+	} else {
+		err = root.Mkdir(path, mode)
+	}
+	if err != nil {
+		return OperationResult{Error: fmt.Errorf("could not create directory: %s", err)}
+	}
+
+	return OperationResult{Content: fmt.Sprintf("directory created at %s", path)}
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestIsSafePath(t *testing.T) {
@@ -24,10 +31,24 @@ func TestIsSafePath(t *testing.T) {
 
 	outsideDir := t.TempDir()
 
+	linkOutside := filepath.Join(baseDir, "link-outside")
+	if err := os.Symlink(outsideDir, linkOutside); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	linkInside := filepath.Join(baseDir, "link-inside")
+	if err := os.Symlink(safeSubDir, linkInside); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	danglingLink := filepath.Join(baseDir, "dangling")
+	if err := os.Symlink(filepath.Join(outsideDir, "missing.txt"), danglingLink); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
 	tests := []struct {
 		name     string
 		base     string
 		target   string
+		policy   symlinkPolicy
 		expected bool
 	}{
 		{
@@ -66,6 +87,57 @@ func TestIsSafePath(t *testing.T) {
 			target:   filepath.Join(baseDir, "nonexistent", "file.txt"),
 			expected: true, // The path is still considered safe even if it doesn't exist
 		},
+		{
+			name:     "sibling directory sharing the base prefix",
+			base:     baseDir,
+			target:   baseDir + "-evil",
+			expected: false,
+		},
+		{
+			name:     "symlink pointing outside base",
+			base:     baseDir,
+			target:   filepath.Join(linkOutside, "file.txt"),
+			expected: false,
+		},
+		{
+			name:     "new file under symlink pointing outside base",
+			base:     baseDir,
+			target:   filepath.Join(linkOutside, "new", "file.txt"),
+			expected: false,
+		},
+		{
+			name:     "dangling symlink pointing outside base",
+			base:     baseDir,
+			target:   danglingLink,
+			expected: false,
+		},
+		{
+			name:     "symlink pointing inside base",
+			base:     baseDir,
+			target:   filepath.Join(linkInside, "file.txt"),
+			expected: true,
+		},
+		{
+			name:     "symlink pointing inside base with deny policy",
+			base:     baseDir,
+			target:   filepath.Join(linkInside, "file.txt"),
+			policy:   symlinkDeny,
+			expected: false,
+		},
+		{
+			name:     "regular file with deny policy",
+			base:     baseDir,
+			target:   safeFile,
+			policy:   symlinkDeny,
+			expected: true,
+		},
+		{
+			name:     "symlink pointing outside base with follow-anywhere policy",
+			base:     baseDir,
+			target:   filepath.Join(linkOutside, "file.txt"),
+			policy:   symlinkFollowAnywhere,
+			expected: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -84,9 +156,9 @@ func TestIsSafePath(t *testing.T) {
 
 			t.Logf("Testing for path '%s'", tt.target)
 
-			actual := isSafePath(tt.base, tt.target)
+			actual := isSafePath(tt.base, tt.target, tt.policy)
 			if actual != tt.expected {
-				t.Errorf("isSafePath(%q, %q) = %v, want %v", tt.base, tt.target, actual, tt.expected)
+				t.Errorf("isSafePath(%q, %q, %s) = %v, want %v", tt.base, tt.target, tt.policy, actual, tt.expected)
 			}
 		})
 	}
@@ -133,7 +205,7 @@ func TestAssertPath(t *testing.T) {
 				tt.setup()
 			}
 
-			gotInfo, gotErr, gotBool := assertPath(tt.path)
+			gotInfo, gotErr, gotBool := assertPath(newTestRoot(t, tmpDir), tt.path)
 
 			if tt.wantInfo && gotInfo == nil {
 				t.Error("expected FileInfo, got nil")
@@ -164,6 +236,7 @@ func TestAssertPath(t *testing.T) {
 
 func TestListEntries(t *testing.T) {
 	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
 
 	os.WriteFile(filepath.Join(tmpDir, "file_1.txt"), []byte("test"), 0644)
 	os.WriteFile(filepath.Join(tmpDir, "file_2.txt"), []byte("test"), 0644)
@@ -186,6 +259,7 @@ func TestListEntries(t *testing.T) {
 		path          string
 		expectContent string
 		expectMessage string
+		filter        entryFilter
 		err           error
 	}{
 		{
@@ -197,9 +271,9 @@ func TestListEntries(t *testing.T) {
 		},
 		{
 			name:          "passing a file path",
-			path:          "/not/exists/dir",
+			path:          filepath.Join(tmpDir, "not", "exists", "dir"),
 			expectContent: "",
-			expectMessage: "path not found at /not/exists/dir",
+			expectMessage: "path not found at " + filepath.Join(tmpDir, "not", "exists", "dir"),
 			err:           errors.New(""),
 		},
 		{
@@ -209,11 +283,23 @@ func TestListEntries(t *testing.T) {
 			expectMessage: "path is not a directory",
 			err:           errors.New(""),
 		},
+		{
+			name: "filtered entries",
+			path: tmpDir,
+			expectContent: "- file_1.txt (file)\n" +
+				"- subpath (directory)\n" +
+				"  - sub_file_1.txt (file)\n",
+			expectMessage: "",
+			filter: func(path string, entry os.DirEntry) bool {
+				return !strings.HasSuffix(entry.Name(), "_2.txt")
+			},
+			err: errors.New(""),
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			operationResult := listEntries(tt.path, 3, "")
+			operationResult := listEntries(context.Background(), root, tt.path, defaultListOptions, tt.filter)
 
 			if operationResult.Error != nil {
 				if tt.err != errors.New("") && operationResult.Error != tt.err {
@@ -232,8 +318,423 @@ func TestListEntries(t *testing.T) {
 	}
 }
 
+func TestListEntriesJSON(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	os.MkdirAll(filepath.Join(tmpDir, "subpath", "deeper"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "file_1.txt"), []byte("test"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "subpath", "sub_file.txt"), []byte("content"), 0600)
+	os.WriteFile(filepath.Join(tmpDir, "subpath", "deeper", "deep_file.txt"), []byte("test"), 0644)
+	os.Symlink("file_1.txt", filepath.Join(tmpDir, "link"))
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(tmpDir, "file_1.txt"), modTime, modTime)
+
+	operationResult := listEntries(context.Background(), root, tmpDir, listOptions{depth: 1, format: listFormatJSON, showHidden: true, sortBy: listSortName}, nil)
+	if operationResult.Error != nil || operationResult.Message != "" {
+		t.Fatalf("unexpected result: %v %v", operationResult.Error, operationResult.Message)
+	}
+
+	var tree struct {
+		Path    string       `json:"path"`
+		Depth   int          `json:"depth"`
+		Entries []*treeEntry `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(operationResult.Content), &tree); err != nil {
+		t.Fatalf("invalid JSON content: %v", err)
+	}
+	structured, _ := json.Marshal(operationResult.Structured)
+	if string(structured) != operationResult.Content {
+		t.Errorf("Expected the content to encode the structured result, got:\n%s\n%s", operationResult.Content, structured)
+	}
+	if tree.Path != tmpDir || tree.Depth != 1 {
+		t.Errorf("Expected path %s and depth 1, got %s and %d", tmpDir, tree.Path, tree.Depth)
+	}
+
+	names := func(entries []*treeEntry) []string {
+		result := []string{}
+		for _, entry := range entries {
+			result = append(result, entry.Path+" "+entry.Type)
+		}
+		return result
+	}
+	if got, expected := names(tree.Entries), []string{"file_1.txt file", "link symlink", "subpath directory"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected entries %v, got %v", expected, got)
+	}
+	subpath := tree.Entries[2]
+	if got, expected := names(subpath.Entries), []string{"subpath/deeper directory", "subpath/sub_file.txt file"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected entries %v, got %v", expected, got)
+	}
+	if len(subpath.Entries[0].Entries) != 0 {
+		t.Errorf("Expected no entries below depth 1, got %v", names(subpath.Entries[0].Entries))
+	}
+
+	file := tree.Entries[0]
+	if file.Name != "file_1.txt" || file.Size != 4 || file.Mode != "-rw-r--r--" || file.ModTime != modTime.Local().Format(time.RFC3339) {
+		t.Errorf("unexpected file entry %+v", file)
+	}
+	if sub := subpath.Entries[1]; sub.Size != 7 || sub.Mode != "-rw-------" {
+		t.Errorf("unexpected file entry %+v", sub)
+	}
+	if link := tree.Entries[1]; link.Target != "file_1.txt" {
+		t.Errorf("Expected the link target to be file_1.txt, got %q", link.Target)
+	}
+
+	if operationResult := listEntries(context.Background(), root, tmpDir, listOptions{format: "xml"}, nil); operationResult.Message != `invalid format "xml", must be text or json` {
+		t.Errorf("unexpected message %q", operationResult.Message)
+	}
+}
+
+func TestListEntriesOptions(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	files := map[string]string{
+		".env":              "a=1",
+		".hidden/inner.txt": "test",
+		"big.log":           strings.Repeat("x", 100),
+		"docs/guide.md":     "test",
+		"docs/readme.md":    "test",
+		"small.go":          "x",
+		"src/main.go":       "test",
+		"src/util.go":       "test",
+		"src/vendor/lib.go": "test",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(tmpDir, name)), 0755)
+		os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644)
+	}
+	os.Symlink("small.go", filepath.Join(tmpDir, "link"))
+	for name, year := range map[string]int{".env": 2024, "big.log": 2023, "small.go": 2025} {
+		modTime := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		os.Chtimes(filepath.Join(tmpDir, name), modTime, modTime)
+	}
+
+	options := func(change func(opts *listOptions)) listOptions {
+		opts := defaultListOptions
+		opts.depth = -1
+		change(&opts)
+		return opts
+	}
+
+	tests := []struct {
+		name          string
+		opts          listOptions
+		expectContent string
+		expectMessage string
+	}{
+		{
+			name: "hide dotfiles",
+			opts: options(func(opts *listOptions) { opts.depth = 0; opts.showHidden = false }),
+			expectContent: "- big.log (file)\n" +
+				"- docs (directory)\n" +
+				"- link (file)\n" +
+				"- small.go (file)\n" +
+				"- src (directory)\n",
+		},
+		{
+			name: "directories only",
+			opts: options(func(opts *listOptions) { opts.entryType = entryTypeDirectory }),
+			expectContent: "- .hidden (directory)\n" +
+				"- docs (directory)\n" +
+				"- src (directory)\n" +
+				"  - vendor (directory)\n",
+		},
+		{
+			name: "include keeps the directories holding matches",
+			opts: options(func(opts *listOptions) { opts.include = "*.go" }),
+			expectContent: "- small.go (file)\n" +
+				"- src (directory)\n" +
+				"  - main.go (file)\n" +
+				"  - util.go (file)\n" +
+				"  - vendor (directory)\n" +
+				"    - lib.go (file)\n",
+		},
+		{
+			name: "exclude leaves out everything below",
+			opts: options(func(opts *listOptions) { opts.include = "*.go"; opts.exclude = "vendor" }),
+			expectContent: "- small.go (file)\n" +
+				"- src (directory)\n" +
+				"  - main.go (file)\n" +
+				"  - util.go (file)\n",
+		},
+		{
+			name: "include with a relative path",
+			opts: options(func(opts *listOptions) { opts.include = "src/*.go" }),
+			expectContent: "- src (directory)\n" +
+				"  - main.go (file)\n" +
+				"  - util.go (file)\n",
+		},
+		{
+			name: "sort by size",
+			opts: options(func(opts *listOptions) { opts.depth = 0; opts.entryType = entryTypeFile; opts.sortBy = listSortSize }),
+			expectContent: "- big.log (file)\n" +
+				"- .env (file)\n" +
+				"- small.go (file)\n",
+		},
+		{
+			name: "sort by mtime",
+			opts: options(func(opts *listOptions) { opts.depth = 0; opts.entryType = entryTypeFile; opts.sortBy = listSortMtime }),
+			expectContent: "- small.go (file)\n" +
+				"- .env (file)\n" +
+				"- big.log (file)\n",
+		},
+		{
+			name: "entries per directory",
+			opts: options(func(opts *listOptions) {
+				opts.depth = 1
+				opts.showHidden = false
+				opts.exclude = "big.log"
+				opts.maxEntries = 1
+			}),
+			expectContent: "- docs (directory)\n" +
+				"  - guide.md (file)\n" +
+				"  - ... 1 more entry\n" +
+				"- ... 3 more entries\n",
+		},
+		{
+			name:          "invalid sort",
+			opts:          options(func(opts *listOptions) { opts.sortBy = "date" }),
+			expectMessage: `invalid sortBy "date", must be name, size or mtime`,
+		},
+		{
+			name:          "invalid glob",
+			opts:          options(func(opts *listOptions) { opts.include = "[" }),
+			expectMessage: `invalid glob pattern "[": syntax error in pattern`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationResult := listEntries(context.Background(), root, tmpDir, tt.opts, nil)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+			if operationResult.Content != tt.expectContent {
+				t.Errorf("Expected:\n%v\nGot:\n%v", tt.expectContent, operationResult.Content)
+			}
+			if operationResult.Message != tt.expectMessage {
+				t.Errorf("Expected message %q, got %q", tt.expectMessage, operationResult.Message)
+			}
+		})
+	}
+
+	opts := options(func(opts *listOptions) { opts.depth = 0; opts.format = listFormatJSON; opts.maxEntries = 5 })
+	if operationResult := listEntries(context.Background(), root, tmpDir, opts, nil); !strings.HasSuffix(operationResult.Content, `"more":2,"path":"`+tmpDir+`"}`) {
+		t.Errorf("Expected the json tree to count the entries left out, got %s", operationResult.Content)
+	}
+}
+
+func TestWalkTree(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	// A tree wide and deep enough to keep every worker busy
+	for i := range 12 {
+		for j := range 12 {
+			dir := filepath.Join(tmpDir, fmt.Sprintf("dir_%02d", i), fmt.Sprintf("sub_%02d", j))
+			os.MkdirAll(filepath.Join(dir, "deep"), 0755)
+			os.WriteFile(filepath.Join(dir, "file.txt"), []byte("test"), 0644)
+			os.WriteFile(filepath.Join(dir, "deep", "file.txt"), []byte("test"), 0644)
+		}
+	}
+	os.WriteFile(filepath.Join(tmpDir, "top.txt"), []byte("test"), 0644)
+
+	walkDirOrder := []string{}
+	filepath.WalkDir(tmpDir, func(path string, entry os.DirEntry, err error) error {
+		if path != tmpDir {
+			walkDirOrder = append(walkDirOrder, path)
+		}
+		return nil
+	})
+
+	walk := func(ctx context.Context, opts walkOptions, visit func(walkEntry) error) ([]string, error) {
+		visited := []string{}
+		err := walkTree(ctx, root, tmpDir, opts, func(entry walkEntry) error {
+			visited = append(visited, entry.path)
+			if visit != nil {
+				return visit(entry)
+			}
+			return nil
+		})
+		return visited, err
+	}
+
+	t.Run("same order as filepath.WalkDir", func(t *testing.T) {
+		for range 5 {
+			visited, err := walk(context.Background(), walkOptions{maxDepth: -1}, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(visited, walkDirOrder) {
+				t.Fatalf("Expected %d entries in filepath.WalkDir order, got %d:\n%v", len(walkDirOrder), len(visited), visited)
+			}
+		}
+	})
+
+	t.Run("depth, relative paths and info", func(t *testing.T) {
+		maxDepth := 0
+		_, err := walk(context.Background(), walkOptions{maxDepth: 1, info: true}, func(entry walkEntry) error {
+			maxDepth = max(maxDepth, entry.depth)
+			if rel, _ := filepath.Rel(tmpDir, entry.path); filepath.ToSlash(rel) != entry.relPath {
+				t.Errorf("Expected relPath %s, got %s", filepath.ToSlash(rel), entry.relPath)
+			}
+			if entry.info == nil || entry.info.Name() != entry.entry.Name() {
+				t.Errorf("Expected the info of %s to be loaded", entry.relPath)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if maxDepth != 1 {
+			t.Errorf("Expected to stop at depth 1, got %d", maxDepth)
+		}
+	})
+
+	t.Run("filter, skip dir and skip all", func(t *testing.T) {
+		opts := walkOptions{
+			maxDepth: -1,
+			filter: func(path string, entry os.DirEntry) bool {
+				return entry.Name() != "deep"
+			},
+		}
+		visited, err := walk(context.Background(), opts, func(entry walkEntry) error {
+			switch entry.relPath {
+			case "dir_00":
+				return filepath.SkipDir
+			case "dir_01/sub_02":
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := []string{"dir_00", "dir_01", "dir_01/sub_00", "dir_01/sub_00/file.txt", "dir_01/sub_01", "dir_01/sub_01/file.txt", "dir_01/sub_02"}
+		for i, path := range expected {
+			expected[i] = filepath.Join(tmpDir, filepath.FromSlash(path))
+		}
+		if !reflect.DeepEqual(visited, expected) {
+			t.Errorf("Expected:\n%v\nGot:\n%v", expected, visited)
+		}
+	})
+
+	t.Run("visit error", func(t *testing.T) {
+		errStop := errors.New("stop")
+		visited, err := walk(context.Background(), walkOptions{maxDepth: -1}, func(entry walkEntry) error {
+			return errStop
+		})
+		if err != errStop || len(visited) != 1 {
+			t.Errorf("Expected the walk to end with %v after one entry, got %v after %d", errStop, err, len(visited))
+		}
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		visited, err := walk(ctx, walkOptions{maxDepth: -1}, func(entry walkEntry) error {
+			if entry.relPath == "dir_02" {
+				cancel()
+			}
+			return nil
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		if len(visited) >= len(walkDirOrder) {
+			t.Errorf("Expected the walk to stop early, visited %d entries", len(visited))
+		}
+	})
+
+	t.Run("directory not found", func(t *testing.T) {
+		err := walkTree(context.Background(), root, filepath.Join(tmpDir, "missing"), walkOptions{maxDepth: -1}, func(entry walkEntry) error {
+			return nil
+		})
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected %v, got %v", os.ErrNotExist, err)
+		}
+	})
+}
+
+func TestMeasureTree(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	os.MkdirAll(filepath.Join(tmpDir, "a", "b"), 0755)
+	os.MkdirAll(filepath.Join(tmpDir, "skipped"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "one.txt"), []byte("12345"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "a", "two.txt"), []byte("1234567890"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "a", "b", "three.txt"), []byte("123"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "skipped", "big.txt"), make([]byte, 1000), 0644)
+	os.Symlink("one.txt", filepath.Join(tmpDir, "link.txt"))
+	for i, name := range []string{"one.txt", "a/two.txt", "a/b/three.txt"} {
+		modTime := time.Date(2020+i, 1, 1, 0, 0, 0, 0, time.UTC)
+		os.Chtimes(filepath.Join(tmpDir, filepath.FromSlash(name)), modTime, modTime)
+	}
+
+	filter := func(path string, entry os.DirEntry) bool {
+		return entry.Name() != "skipped"
+	}
+	usage, err := measureTree(context.Background(), root, tmpDir, filter)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	usage.newestTime, usage.oldestTime = time.Time{}, time.Time{}
+	expected := treeUsage{
+		files:       4,
+		directories: 2,
+		size:        18,
+		extensions:  map[string]int{".txt": 4},
+		newest:      "link.txt",
+		oldest:      "one.txt",
+	}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, usage)
+	}
+}
+
+func TestGetDirectoryInfo(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	files := map[string]int{"main.go": 2024, "util.go": 2022, "docs/README.MD": 2023, "docs/notes": 2025, "secret.key": 2026}
+	for name, year := range files {
+		filePath := filepath.Join(tmpDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		os.WriteFile(filePath, []byte("test"), 0644)
+		modTime := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		os.Chtimes(filePath, modTime, modTime)
+	}
+	filter := func(path string, entry os.DirEntry) bool {
+		return !strings.HasSuffix(entry.Name(), ".key")
+	}
+
+	operationResult := getFileInfo(context.Background(), root, tmpDir, false, filter)
+	if !strings.HasPrefix(operationResult.Content, "Directory: "+tmpDir+"\nEntries: 3\nPermissions: drwx") {
+		t.Errorf("unexpected directory info:\n%s", operationResult.Content)
+	}
+	if strings.Contains(operationResult.Content, "Total Size") {
+		t.Errorf("Expected no aggregate figures without aggregate, got:\n%s", operationResult.Content)
+	}
+
+	operationResult = getFileInfo(context.Background(), root, tmpDir, true, filter)
+	if operationResult.Error != nil {
+		t.Fatalf("unexpected error: %v", operationResult.Error)
+	}
+	expectContent := "Total Size: 16 bytes\n" +
+		"Files: 4\n" +
+		"Directories: 1\n" +
+		"Files by Extension: .go 2, no extension 1, .md 1\n" +
+		"Newest File: docs/notes (" + time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local().Format(time.RFC3339) + ")\n" +
+		"Oldest File: util.go (" + time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC).Local().Format(time.RFC3339) + ")\n"
+	if !strings.HasSuffix(operationResult.Content, expectContent) {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expectContent, operationResult.Content)
+	}
+}
+
 func TestReadFile(t *testing.T) {
 	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
 
 	os.WriteFile(filepath.Join(tmpDir, "file_1.txt"), []byte("test"), 0644)
 	subDir := filepath.Join(tmpDir, "subpath")
@@ -259,15 +760,15 @@ func TestReadFile(t *testing.T) {
 		},
 		{
 			name:          "read file sucessfully",
-			path:          "/not/exists/file.txt",
-			expectMessage: "path not found at /not/exists/file.txt",
+			path:          filepath.Join(tmpDir, "not", "exists", "file.txt"),
+			expectMessage: "path not found at " + filepath.Join(tmpDir, "not", "exists", "file.txt"),
 			expectContent: "",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			operationResult := readFile(tt.path)
+			operationResult := readFile(root, tt.path, 0)
 			if operationResult.Error != nil {
 				t.Errorf("unexpected error: %v", operationResult.Error)
 			}
@@ -284,6 +785,7 @@ func TestReadFile(t *testing.T) {
 
 func TestWriteToFile(t *testing.T) {
 	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
 
 	// Setup test file and directory
 	filePath := filepath.Join(tmpDir, "existing.txt")
@@ -332,7 +834,7 @@ func TestWriteToFile(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := writeToFile(tt.content, tt.path)
+			result := writeToFile(root, tt.content, tt.path, 0, defaultFilePerms)
 
 			if tt.isError {
 				if result.Error == nil {
@@ -361,8 +863,166 @@ func TestWriteToFile(t *testing.T) {
 	}
 }
 
+func TestWriteToFileMode(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	scriptPath := filepath.Join(tmpDir, "script.sh")
+	if err := os.WriteFile(scriptPath, []byte("#!/bin/sh"), 0755); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	perms := filePerms{file: 0640, dir: 0700}
+
+	tests := []struct {
+		name       string
+		path       string
+		mode       os.FileMode
+		expectMode os.FileMode
+	}{
+		{
+			name:       "new file gets the default mode",
+			path:       filepath.Join(tmpDir, "new.txt"),
+			expectMode: 0640,
+		},
+		{
+			name:       "existing file keeps its mode",
+			path:       scriptPath,
+			expectMode: 0755,
+		},
+		{
+			name:       "explicit mode",
+			path:       scriptPath,
+			mode:       0700,
+			expectMode: 0700,
+		},
+		{
+			name:       "new directory gets the default mode",
+			path:       filepath.Join(tmpDir, "dir", "file.txt"),
+			expectMode: 0640,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := writeToFile(root, "content", tt.path, tt.mode, perms)
+			if result.Error != nil {
+				t.Fatalf("Unexpected error: %v", result.Error)
+			}
+
+			info, err := os.Stat(tt.path)
+			if err != nil {
+				t.Fatalf("Failed to stat %s: %v", tt.path, err)
+			}
+			if info.Mode().Perm() != tt.expectMode {
+				t.Errorf("Got mode %v, expected: %v", info.Mode().Perm(), tt.expectMode)
+			}
+		})
+	}
+
+	info, err := os.Stat(filepath.Join(tmpDir, "dir"))
+	if err != nil {
+		t.Fatalf("Failed to stat the created directory: %v", err)
+	}
+	if info.Mode().Perm() != perms.dir {
+		t.Errorf("Got directory mode %v, expected: %v", info.Mode().Perm(), perms.dir)
+	}
+}
+
+func TestCreatedModesIgnoreUmask(t *testing.T) {
+	// A umask that clears every bit the modes below give to the group and others
+	defer syscall.Umask(syscall.Umask(0077))
+
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+	perms := filePerms{file: 0664, dir: 0775}
+
+	srcDir := filepath.Join(tmpDir, "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0700); err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+	if err := os.Chmod(srcDir, 0755); err != nil {
+		t.Fatalf("Failed to chmod test directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "sub", "file.txt"), []byte("content"), 0600); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	for _, name := range []string{"moved.txt", "trashed.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte("content"), 0600); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		operation   func() OperationResult
+		expectModes map[string]os.FileMode
+	}{
+		{
+			name: "writeToFile",
+			operation: func() OperationResult {
+				return writeToFile(root, "content", filepath.Join(tmpDir, "w", "x", "f.txt"), 0, perms)
+			},
+			expectModes: map[string]os.FileMode{"w": 0775, "w/x": 0775, "w/x/f.txt": 0664},
+		},
+		{
+			name: "appendToFile",
+			operation: func() OperationResult {
+				return appendToFile(root, "content", filepath.Join(tmpDir, "a", "f.txt"), false, perms)
+			},
+			expectModes: map[string]os.FileMode{"a": 0775, "a/f.txt": 0664},
+		},
+		{
+			name: "copy",
+			operation: func() OperationResult {
+				return copyFileOrDir(context.Background(), root, srcDir, root, filepath.Join(tmpDir, "c", "dst"), nil, nil, perms)
+			},
+			expectModes: map[string]os.FileMode{"c": 0775, "c/dst": 0755, "c/dst/sub": 0700, "c/dst/sub/file.txt": 0664},
+		},
+		{
+			name: "move",
+			operation: func() OperationResult {
+				return movePath(context.Background(), root, filepath.Join(tmpDir, "moved.txt"), root, filepath.Join(tmpDir, "m", "moved.txt"), false, nil, nil, perms)
+			},
+			expectModes: map[string]os.FileMode{"m": 0775},
+		},
+		{
+			name: "trash",
+			operation: func() OperationResult {
+				return deletePath(context.Background(), root, filepath.Join(tmpDir, "trashed.txt"), false, true, nil, nil, perms)
+			},
+			expectModes: map[string]os.FileMode{trashDirName: 0775},
+		},
+		{
+			name: "createDirectory",
+			operation: func() OperationResult {
+				return createDirectory(root, filepath.Join(tmpDir, "d", "e"), true, 0770)
+			},
+			expectModes: map[string]os.FileMode{"d": 0770, "d/e": 0770},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := tt.operation(); result.Error != nil || result.Message != "" {
+				t.Fatalf("Unexpected result: %v %q", result.Error, result.Message)
+			}
+
+			for path, expectMode := range tt.expectModes {
+				info, err := os.Stat(filepath.Join(tmpDir, path))
+				if err != nil {
+					t.Fatalf("Failed to stat %s: %v", path, err)
+				}
+				if info.Mode().Perm() != expectMode {
+					t.Errorf("Got mode %v for %s, expected: %v", info.Mode().Perm(), path, expectMode)
+				}
+			}
+		})
+	}
+}
+
 func TestGetFileInfo(t *testing.T) {
 	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
 
 	filePath := filepath.Join(tmpDir, "file_1.txt")
 	if err := os.WriteFile(filePath, []byte("test"), 0644); err != nil {
@@ -389,20 +1049,20 @@ func TestGetFileInfo(t *testing.T) {
 		{
 			name:          "path is directory",
 			path:          subDir,
-			expectMessage: "path is a directory, must be a file",
-			expectContent: "",
+			expectMessage: "",
+			expectContent: "Directory: " + subDir + "\nEntries: 0\n",
 		},
 		{
 			name:          "path does not exist",
-			path:          "/not/exists/file.txt",
-			expectMessage: "path not found at /not/exists/file.txt",
+			path:          filepath.Join(tmpDir, "not", "exists", "file.txt"),
+			expectMessage: "path not found at " + filepath.Join(tmpDir, "not", "exists", "file.txt"),
 			expectContent: "",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			operationResult := getFileInfo(tt.path)
+			operationResult := getFileInfo(context.Background(), root, tt.path, false, nil)
 			if operationResult.Error != nil {
 				t.Errorf("unexpected error: %v", operationResult.Error)
 			}
@@ -418,6 +1078,7 @@ func TestGetFileInfo(t *testing.T) {
 }
 func TestRenameFilaAndDir(t *testing.T) {
 	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
 
 	filePathOne := filepath.Join(tmpDir, "file_1.txt")
 	if err := os.WriteFile(filePathOne, []byte("test"), 0644); err != nil {
@@ -456,9 +1117,9 @@ func TestRenameFilaAndDir(t *testing.T) {
 		},
 		{
 			name:          "path does not exist",
-			path:          "/not/exists/file.txt",
+			path:          filepath.Join(tmpDir, "not", "exists", "file.txt"),
 			newPathName:   "updated_file_name.txt",
-			expectMessage: "path not found at /not/exists/file.txt",
+			expectMessage: "path not found at " + filepath.Join(tmpDir, "not", "exists", "file.txt"),
 			expectContent: "",
 		},
 		{
@@ -472,7 +1133,7 @@ func TestRenameFilaAndDir(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			operationResult := renamePath(tt.path, tt.newPathName)
+			operationResult := renamePath(context.Background(), root, tt.path, tt.newPathName, nil)
 			if operationResult.Error != nil {
 				t.Errorf("unexpected error: %v", operationResult.Error)
 			}
@@ -489,6 +1150,7 @@ func TestRenameFilaAndDir(t *testing.T) {
 
 func TestCopyFileOrDir(t *testing.T) {
 	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
 
 	filePath := filepath.Join(tmpDir, "file.txt")
 	content := []byte("Hello, World!")
@@ -537,7 +1199,7 @@ func TestCopyFileOrDir(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			operationResult := copyFileOrDir(tt.source, tt.destination)
+			operationResult := copyFileOrDir(context.Background(), root, tt.source, root, tt.destination, nil, nil, defaultFilePerms)
 			if operationResult.Error != nil {
 				t.Errorf("unexpected error: %v", operationResult.Error)
 			}
@@ -550,4 +1212,1496 @@ func TestCopyFileOrDir(t *testing.T) {
 			}
 		})
 	}
+
+	// Missing parents get the configured directory mode, the copied directory keeps the mode of its source
+	perms := filePerms{file: 0600, dir: 0700}
+	nestedCopy := filepath.Join(tmpDir, "new", "parent", "folder_copy")
+	if operationResult := copyFileOrDir(context.Background(), root, folderPath, root, nestedCopy, nil, nil, perms); operationResult.Error != nil {
+		t.Fatalf("unexpected error: %v", operationResult.Error)
+	}
+	for path, mode := range map[string]os.FileMode{
+		filepath.Join(tmpDir, "new"):           perms.dir,
+		filepath.Join(tmpDir, "new", "parent"): perms.dir,
+		nestedCopy:                             0755,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", path, err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("Got mode %v for %s, expected: %v", info.Mode().Perm(), path, mode)
+		}
+	}
+}
+
+func newTestRoot(t *testing.T, dir string) *fsRoot {
+	t.Helper()
+
+	root, err := openRoot(rootSpec{dir: dir}, symlinkFollowWithinRoot)
+	if err != nil {
+		t.Fatalf("Failed to open root: %v", err)
+	}
+	t.Cleanup(func() { root.Close() })
+	return root
+}
+
+func TestListRoots(t *testing.T) {
+	repoDir := t.TempDir()
+	docsDir := t.TempDir()
+
+	repo, err := openRoot(rootSpec{name: "repo", dir: repoDir}, symlinkFollowWithinRoot)
+	if err != nil {
+		t.Fatalf("Failed to open root: %v", err)
+	}
+	defer repo.Close()
+	docs, err := openRoot(rootSpec{name: "docs", dir: docsDir, readOnly: true}, symlinkFollowWithinRoot)
+	if err != nil {
+		t.Fatalf("Failed to open root: %v", err)
+	}
+	defer docs.Close()
+
+	expectContent := "- repo (root, read-write): " + repoDir + "\n" +
+		"- docs (root, read-only): " + docsDir + "\n"
+
+	operationResult := listRoots([]*fsRoot{repo, docs})
+	if operationResult.Content != expectContent {
+		t.Errorf("Expected:\n%v\nGot:\n%v", expectContent, operationResult.Content)
+	}
+}
+
+func TestReadOnlyRoot(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	filePath := filepath.Join(tmpDir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	root, err := openRoot(rootSpec{name: "docs", dir: tmpDir, readOnly: true}, symlinkFollowWithinRoot)
+	if err != nil {
+		t.Fatalf("Failed to open root: %v", err)
+	}
+	defer root.Close()
+
+	expectMessage := "access denied: root 'docs' is read-only"
+
+	tests := []struct {
+		name      string
+		operation func() OperationResult
+	}{
+		{
+			name:      "write to file",
+			operation: func() OperationResult { return writeToFile(root, "updated", filePath, 0, defaultFilePerms) },
+		},
+		{
+			name:      "rename file",
+			operation: func() OperationResult { return renamePath(context.Background(), root, filePath, "renamed.txt", nil) },
+		},
+		{
+			name: "copy file",
+			operation: func() OperationResult {
+				return copyFileOrDir(context.Background(), root, filePath, root, filepath.Join(tmpDir, "copy.txt"), nil, nil, defaultFilePerms)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationResult := tt.operation()
+			if operationResult.Error != nil {
+				t.Errorf("unexpected error: %v", operationResult.Error)
+			}
+			if operationResult.Message != expectMessage {
+				t.Errorf("Got %s, expected: %s", operationResult.Message, expectMessage)
+			}
+		})
+	}
+
+	if _, err := root.Create(filepath.Join(tmpDir, "new.txt")); !errors.Is(err, errReadOnlyRoot) {
+		t.Errorf("Expected read-only error creating a file, got: %v", err)
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	if string(content) != "test" {
+		t.Errorf("File was modified in a read-only root: %q", content)
+	}
+}
+
+func TestDeletePath(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	filePath := filepath.Join(tmpDir, "file.txt")
+	dirPath := filepath.Join(tmpDir, "folder")
+	trashedFilePath := filepath.Join(tmpDir, "subdir", "trashed.txt")
+	trashedDirPath := filepath.Join(tmpDir, "trashed-folder")
+	for _, path := range []string{
+		filePath,
+		filepath.Join(dirPath, "nested.txt"),
+		trashedFilePath,
+		filepath.Join(trashedDirPath, "nested.txt"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create test directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		recursive     bool
+		trash         bool
+		expectMessage string
+		expectContent string
+		expectTrashed string
+	}{
+		{
+			name:          "directory without recursive",
+			path:          dirPath,
+			expectMessage: "path is a directory, set recursive to delete it",
+		},
+		{
+			name:          "delete a file",
+			path:          filePath,
+			expectContent: "path deleted successfully",
+		},
+		{
+			name:          "delete a directory recursively",
+			path:          dirPath,
+			recursive:     true,
+			expectContent: "path deleted successfully",
+		},
+		{
+			name:          "path does not exist",
+			path:          filepath.Join(tmpDir, "nonexistent.txt"),
+			expectMessage: "path not found at " + filepath.Join(tmpDir, "nonexistent.txt"),
+		},
+		{
+			name:          "root directory",
+			path:          tmpDir,
+			recursive:     true,
+			expectMessage: "cannot delete the root directory",
+		},
+		{
+			name:          "move a file to trash",
+			path:          trashedFilePath,
+			trash:         true,
+			expectTrashed: filepath.Join("subdir", "trashed.txt"),
+		},
+		{
+			name:          "move a directory to trash",
+			path:          trashedDirPath,
+			recursive:     true,
+			trash:         true,
+			expectTrashed: filepath.Join("trashed-folder", "nested.txt"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationResult := deletePath(context.Background(), root, tt.path, tt.recursive, tt.trash, nil, nil, defaultFilePerms)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+
+			if operationResult.Message != tt.expectMessage {
+				t.Errorf("Got %s, expected: %s", operationResult.Message, tt.expectMessage)
+			}
+
+			if tt.expectTrashed != "" {
+				trashPath := strings.TrimPrefix(operationResult.Content, "path moved to trash at ")
+				if !strings.HasPrefix(trashPath, filepath.Join(tmpDir, trashDirName)) {
+					t.Fatalf("Got %s, expected a path inside the trash directory", operationResult.Content)
+				}
+				matches, _ := filepath.Glob(filepath.Join(tmpDir, trashDirName, "*", tt.expectTrashed))
+				if len(matches) != 1 {
+					t.Errorf("Expected %s inside the trash directory, found %v", tt.expectTrashed, matches)
+				}
+			} else if operationResult.Content != tt.expectContent {
+				t.Errorf("Got %s, expected: %s", operationResult.Content, tt.expectContent)
+			}
+
+			if tt.expectMessage == "" {
+				if _, err := os.Lstat(tt.path); !os.IsNotExist(err) {
+					t.Errorf("Expected %s to be deleted, got: %v", tt.path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDeletePathProtectedEntries(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	for _, name := range []string{"certs/key.pem", "certs/public/cert.txt", "logs/app.log"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tmpDir, name)), 0755)
+		os.WriteFile(filepath.Join(tmpDir, name), []byte("test"), 0644)
+	}
+	writable := func(path string, entry os.DirEntry) bool {
+		return !strings.HasSuffix(entry.Name(), ".pem")
+	}
+	certs := filepath.Join(tmpDir, "certs")
+	expectMessage := fmt.Sprintf("cannot delete %s, %s below it is protected by path rules", certs, filepath.Join(certs, "key.pem"))
+
+	for _, trash := range []bool{false, true} {
+		operationResult := deletePath(context.Background(), root, certs, true, trash, writable, nil, defaultFilePerms)
+		if operationResult.Message != expectMessage {
+			t.Errorf("Got %q with trash %v, expected: %q", operationResult.Message, trash, expectMessage)
+		}
+		if _, err := os.Stat(filepath.Join(certs, "key.pem")); err != nil {
+			t.Errorf("Expected the protected file to be kept, got: %v", err)
+		}
+	}
+
+	perms := filePerms{file: 0600, dir: 0700}
+	operationResult := deletePath(context.Background(), root, filepath.Join(tmpDir, "logs"), true, true, writable, nil, perms)
+	if operationResult.Error != nil || operationResult.Message != "" {
+		t.Fatalf("unexpected result: %v %q", operationResult.Error, operationResult.Message)
+	}
+	info, err := os.Stat(filepath.Join(tmpDir, trashDirName))
+	if err != nil {
+		t.Fatalf("Failed to stat the trash directory: %v", err)
+	}
+	if info.Mode().Perm() != perms.dir {
+		t.Errorf("Got mode %v, expected: %v", info.Mode().Perm(), perms.dir)
+	}
+}
+
+func TestMovePath(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+	otherDir := t.TempDir()
+	otherRoot := newTestRoot(t, otherDir)
+
+	for _, name := range []string{"file.txt", "existing.txt", "other.txt", "cross.txt", "folder/nested.txt", "subdir/keep.txt"} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create test directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		dstRoot       *fsRoot
+		destination   string
+		overwrite     bool
+		expectMessage string
+		expectContent string
+	}{
+		{
+			name:          "move a file into another directory",
+			path:          filepath.Join(tmpDir, "file.txt"),
+			dstRoot:       root,
+			destination:   filepath.Join(tmpDir, "new", "dir", "file.txt"),
+			expectContent: filepath.Join(tmpDir, "new", "dir", "file.txt"),
+		},
+		{
+			name:          "move a directory",
+			path:          filepath.Join(tmpDir, "folder"),
+			dstRoot:       root,
+			destination:   filepath.Join(tmpDir, "subdir", "folder"),
+			expectContent: filepath.Join(tmpDir, "subdir", "folder"),
+		},
+		{
+			name:          "destination exists",
+			path:          filepath.Join(tmpDir, "other.txt"),
+			dstRoot:       root,
+			destination:   filepath.Join(tmpDir, "existing.txt"),
+			expectMessage: fmt.Sprintf("target path %s already exists", filepath.Join(tmpDir, "existing.txt")),
+		},
+		{
+			name:          "destination exists with a different type",
+			path:          filepath.Join(tmpDir, "other.txt"),
+			dstRoot:       root,
+			destination:   filepath.Join(tmpDir, "subdir"),
+			overwrite:     true,
+			expectMessage: fmt.Sprintf("target path %s already exists with a different type", filepath.Join(tmpDir, "subdir")),
+		},
+		{
+			name:          "overwrite destination",
+			path:          filepath.Join(tmpDir, "other.txt"),
+			dstRoot:       root,
+			destination:   filepath.Join(tmpDir, "existing.txt"),
+			overwrite:     true,
+			expectContent: filepath.Join(tmpDir, "existing.txt"),
+		},
+		{
+			name:          "move across roots",
+			path:          filepath.Join(tmpDir, "cross.txt"),
+			dstRoot:       otherRoot,
+			destination:   filepath.Join(otherDir, "cross.txt"),
+			expectContent: filepath.Join(otherDir, "cross.txt"),
+		},
+		{
+			name:          "path does not exist",
+			path:          filepath.Join(tmpDir, "nonexistent.txt"),
+			dstRoot:       root,
+			destination:   filepath.Join(tmpDir, "moved.txt"),
+			expectMessage: "path not found at " + filepath.Join(tmpDir, "nonexistent.txt"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationResult := movePath(context.Background(), root, tt.path, tt.dstRoot, tt.destination, tt.overwrite, nil, nil, defaultFilePerms)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+
+			if operationResult.Message != tt.expectMessage {
+				t.Errorf("Got %s, expected: %s", operationResult.Message, tt.expectMessage)
+			}
+			if operationResult.Content != tt.expectContent {
+				t.Errorf("Got %s, expected: %s", operationResult.Content, tt.expectContent)
+			}
+
+			if tt.expectMessage == "" {
+				if _, err := os.Lstat(tt.path); !os.IsNotExist(err) {
+					t.Errorf("Expected %s to be moved, got: %v", tt.path, err)
+				}
+				if _, err := os.Lstat(tt.destination); err != nil {
+					t.Errorf("Expected %s to exist, got: %v", tt.destination, err)
+				}
+			}
+		})
+	}
+
+	content, err := os.ReadFile(filepath.Join(tmpDir, "existing.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read moved file: %v", err)
+	}
+	if string(content) != "other.txt" {
+		t.Errorf("Got %q after overwrite, expected: %q", content, "other.txt")
+	}
+}
+
+func TestMovePathReplace(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+	otherDir := t.TempDir()
+	otherRoot := newTestRoot(t, otherDir)
+
+	files := map[string]string{
+		"parent/child/precious.txt": "precious",
+		"newdir/x.txt":              "new",
+		"olddir/y.txt":              "old",
+		"broken/ok.txt":             "ok",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(tmpDir, name)), 0755)
+		os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644)
+	}
+	// A named pipe cannot be moved across roots, which makes copying this directory fail halfway
+	syscall.Mkfifo(filepath.Join(tmpDir, "broken", "zz-fifo"), 0644)
+	os.MkdirAll(filepath.Join(otherDir, "restore"), 0755)
+	os.WriteFile(filepath.Join(otherDir, "restore", "keep.txt"), []byte("keep"), 0644)
+
+	names := func(dir string) []string {
+		entries, _ := os.ReadDir(dir)
+		result := []string{}
+		for _, entry := range entries {
+			result = append(result, entry.Name())
+		}
+		return result
+	}
+
+	t.Run("move a directory inside itself", func(t *testing.T) {
+		path := filepath.Join(tmpDir, "parent")
+		operationResult := movePath(context.Background(), root, path, root, filepath.Join(path, "child"), true, nil, nil, defaultFilePerms)
+		if expected := fmt.Sprintf("cannot move %s to itself or inside itself", path); operationResult.Message != expected {
+			t.Errorf("Got %q, expected: %q", operationResult.Message, expected)
+		}
+		if _, err := os.Stat(filepath.Join(path, "child", "precious.txt")); err != nil {
+			t.Errorf("Expected the destination to be kept, got: %v", err)
+		}
+	})
+
+	t.Run("overwrite a directory", func(t *testing.T) {
+		operationResult := movePath(context.Background(), root, filepath.Join(tmpDir, "newdir"), root, filepath.Join(tmpDir, "olddir"), true, nil, nil, defaultFilePerms)
+		if operationResult.Error != nil || operationResult.Message != "" {
+			t.Fatalf("unexpected result: %v %q", operationResult.Error, operationResult.Message)
+		}
+		if got := names(filepath.Join(tmpDir, "olddir")); !reflect.DeepEqual(got, []string{"x.txt"}) {
+			t.Errorf("Expected the directory to be replaced, got %v", got)
+		}
+		if got := names(tmpDir); slices.ContainsFunc(got, func(name string) bool { return strings.HasPrefix(name, ".olddir") }) {
+			t.Errorf("Expected no leftover of the replaced directory, got %v", got)
+		}
+	})
+
+	t.Run("failed move restores the destination", func(t *testing.T) {
+		path := filepath.Join(tmpDir, "broken")
+		operationResult := movePath(context.Background(), root, path, otherRoot, filepath.Join(otherDir, "restore"), true, nil, nil, defaultFilePerms)
+		if operationResult.Error == nil {
+			t.Fatalf("Expected the move to fail, got %q %q", operationResult.Content, operationResult.Message)
+		}
+		if got := names(filepath.Join(otherDir, "restore")); !reflect.DeepEqual(got, []string{"keep.txt"}) {
+			t.Errorf("Expected the destination to be restored, got %v", got)
+		}
+		if got := names(otherDir); !reflect.DeepEqual(got, []string{"restore"}) {
+			t.Errorf("Expected no leftover next to the destination, got %v", got)
+		}
+		if got := names(path); !reflect.DeepEqual(got, []string{"ok.txt", "zz-fifo"}) {
+			t.Errorf("Expected the source to be kept, got %v", got)
+		}
+	})
+
+	t.Run("move across roots keeps modes and symlinks", func(t *testing.T) {
+		src := filepath.Join(tmpDir, "tools")
+		os.MkdirAll(filepath.Join(src, "bin"), 0755)
+		os.WriteFile(filepath.Join(src, "bin", "run.sh"), []byte("#!/bin/sh\n"), 0644)
+		os.Chmod(filepath.Join(src, "bin", "run.sh"), 0775)
+		os.Chmod(filepath.Join(src, "bin"), 0777)
+		os.Symlink("bin/run.sh", filepath.Join(src, "run"))
+
+		dst := filepath.Join(otherDir, "tools")
+		operationResult := movePath(context.Background(), root, src, otherRoot, dst, false, nil, nil, defaultFilePerms)
+		if operationResult.Error != nil || operationResult.Message != "" {
+			t.Fatalf("unexpected result: %v %q", operationResult.Error, operationResult.Message)
+		}
+		for name, expected := range map[string]os.FileMode{"bin": 0777, "bin/run.sh": 0775} {
+			if info, err := os.Lstat(filepath.Join(dst, name)); err != nil || info.Mode().Perm() != expected {
+				t.Errorf("Expected %s to have mode %v, got %v (%v)", name, expected, info.Mode().Perm(), err)
+			}
+		}
+		if target, err := os.Readlink(filepath.Join(dst, "run")); err != nil || target != "bin/run.sh" {
+			t.Errorf("Expected run to be a link to bin/run.sh, got %q (%v)", target, err)
+		}
+		if _, err := os.Lstat(src); !os.IsNotExist(err) {
+			t.Errorf("Expected the source to be removed, got: %v", err)
+		}
+	})
+
+	t.Run("parent directories get the configured mode", func(t *testing.T) {
+		perms := filePerms{file: 0600, dir: 0700}
+		dst := filepath.Join(tmpDir, "created", "precious.txt")
+		operationResult := movePath(context.Background(), root, filepath.Join(tmpDir, "parent", "child", "precious.txt"), root, dst, false, nil, nil, perms)
+		if operationResult.Error != nil || operationResult.Message != "" {
+			t.Fatalf("unexpected result: %v %q", operationResult.Error, operationResult.Message)
+		}
+		info, err := os.Stat(filepath.Dir(dst))
+		if err != nil {
+			t.Fatalf("Failed to stat the created directory: %v", err)
+		}
+		if info.Mode().Perm() != perms.dir {
+			t.Errorf("Got mode %v, expected: %v", info.Mode().Perm(), perms.dir)
+		}
+	})
+}
+
+func TestCreateDirectory(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	filePath := filepath.Join(tmpDir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		parents       bool
+		mode          os.FileMode
+		expectMessage string
+		expectContent string
+	}{
+		{
+			name:          "create a directory",
+			path:          filepath.Join(tmpDir, "folder"),
+			mode:          0750,
+			expectContent: "directory created at " + filepath.Join(tmpDir, "folder"),
+		},
+		{
+			name:          "directory already exists",
+			path:          filepath.Join(tmpDir, "folder"),
+			mode:          0750,
+			expectMessage: "directory already exists at " + filepath.Join(tmpDir, "folder"),
+		},
+		{
+			name:          "path is a file",
+			path:          filePath,
+			mode:          0750,
+			expectMessage: fmt.Sprintf("path already exists at %s and is not a directory", filePath),
+		},
+		{
+			name:          "missing parent without parents",
+			path:          filepath.Join(tmpDir, "a", "b"),
+			mode:          0750,
+			expectMessage: fmt.Sprintf("parent directory not found at %s, set parents to create it", filepath.Join(tmpDir, "a")),
+		},
+		{
+			name:          "missing parent with parents",
+			path:          filepath.Join(tmpDir, "a", "b"),
+			parents:       true,
+			mode:          0700,
+			expectContent: "directory created at " + filepath.Join(tmpDir, "a", "b"),
+		},
+		{
+			name:          "explicit mode",
+			path:          filepath.Join(tmpDir, "shared"),
+			mode:          0777,
+			expectContent: "directory created at " + filepath.Join(tmpDir, "shared"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationResult := createDirectory(root, tt.path, tt.parents, tt.mode)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+
+			if operationResult.Message != tt.expectMessage {
+				t.Errorf("Got %s, expected: %s", operationResult.Message, tt.expectMessage)
+			}
+			if operationResult.Content != tt.expectContent {
+				t.Errorf("Got %s, expected: %s", operationResult.Content, tt.expectContent)
+			}
+
+			if tt.expectContent != "" {
+				info, err := os.Stat(tt.path)
+				if err != nil {
+					t.Fatalf("Expected directory at %s, got: %v", tt.path, err)
+				}
+				if info.Mode().Perm() != tt.mode {
+					t.Errorf("Got mode %v, expected: %v", info.Mode().Perm(), tt.mode)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		value     string
+		expect    os.FileMode
+		expectErr bool
+	}{
+		{value: "755", expect: 0755},
+		{value: "0644", expect: 0644},
+		{value: "0o600", expectErr: true},
+		{value: "888", expectErr: true},
+		{value: "1777", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			mode, err := parseFileMode(tt.value)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("Expected error, got %v", mode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if mode != tt.expect {
+				t.Errorf("Got %v, expected: %v", mode, tt.expect)
+			}
+		})
+	}
+}
+
+func TestReadFileRange(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	filePath := filepath.Join(tmpDir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("line 1\nline 2\nline 3\nline 4\nline 5"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	utf8Path := filepath.Join(tmpDir, "utf8.txt")
+	if err := os.WriteFile(utf8Path, []byte("añb\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		unit           string
+		offset         int64
+		limit          int64
+		maxBytes       int64
+		expectMessage  string
+		expectContent  string
+		expectMetadata map[string]any
+	}{
+		{
+			name:          "first lines",
+			path:          filePath,
+			unit:          readUnitLines,
+			limit:         2,
+			expectContent: "line 1\nline 2\n",
+			expectMetadata: map[string]any{
+				"unit": "lines", "offset": int64(0), "returned": int64(2), "totalLines": int64(5),
+				"totalBytes": int64(34), "hasMore": true, "nextOffset": int64(2),
+			},
+		},
+		{
+			name:          "last lines",
+			path:          filePath,
+			unit:          readUnitLines,
+			offset:        3,
+			limit:         10,
+			expectContent: "line 4\nline 5",
+			expectMetadata: map[string]any{
+				"unit": "lines", "offset": int64(3), "returned": int64(2), "totalLines": int64(5),
+				"totalBytes": int64(34), "hasMore": false,
+			},
+		},
+		{
+			name:          "lines up to the end",
+			path:          filePath,
+			unit:          readUnitLines,
+			offset:        4,
+			expectContent: "line 5",
+			expectMetadata: map[string]any{
+				"unit": "lines", "offset": int64(4), "returned": int64(1), "totalLines": int64(5),
+				"totalBytes": int64(34), "hasMore": false,
+			},
+		},
+		{
+			name:          "offset past the end",
+			path:          filePath,
+			unit:          readUnitLines,
+			offset:        10,
+			expectContent: "",
+			expectMetadata: map[string]any{
+				"unit": "lines", "offset": int64(10), "returned": int64(0), "totalLines": int64(5),
+				"totalBytes": int64(34), "hasMore": false,
+			},
+		},
+		{
+			name:          "bytes range",
+			path:          filePath,
+			unit:          readUnitBytes,
+			offset:        7,
+			limit:         6,
+			expectContent: "line 2",
+			expectMetadata: map[string]any{
+				"unit": "bytes", "offset": int64(7), "returned": int64(6), "totalLines": int64(5),
+				"totalBytes": int64(34), "hasMore": true, "nextOffset": int64(13),
+			},
+		},
+		{
+			name:          "bytes range cutting a multi-byte character",
+			path:          utf8Path,
+			unit:          readUnitBytes,
+			limit:         2,
+			expectContent: "a",
+			expectMetadata: map[string]any{
+				"unit": "bytes", "offset": int64(0), "returned": int64(1), "totalLines": int64(1),
+				"totalBytes": int64(5), "hasMore": true, "nextOffset": int64(1),
+			},
+		},
+		{
+			name:          "bytes range starting inside a multi-byte character",
+			path:          utf8Path,
+			unit:          readUnitBytes,
+			offset:        2,
+			expectContent: "b\n",
+			expectMetadata: map[string]any{
+				"unit": "bytes", "offset": int64(3), "returned": int64(2), "totalLines": int64(1),
+				"totalBytes": int64(5), "hasMore": false,
+			},
+		},
+		{
+			name:          "lines cut at maxBytes",
+			path:          filePath,
+			unit:          readUnitLines,
+			maxBytes:      20,
+			expectContent: "line 1\nline 2\n",
+			expectMetadata: map[string]any{
+				"unit": "lines", "offset": int64(0), "returned": int64(2), "totalLines": int64(5),
+				"totalBytes": int64(34), "hasMore": true, "nextOffset": int64(2),
+				"truncated": true, "responseBytes": int64(14), "omittedBytes": int64(20),
+				"hint": "call readFromFile again with unit=lines and offset=2 to read the rest",
+			},
+		},
+		{
+			name:          "first line longer than maxBytes",
+			path:          filePath,
+			unit:          readUnitLines,
+			offset:        1,
+			maxBytes:      4,
+			expectContent: "line",
+			expectMetadata: map[string]any{
+				"unit": "lines", "offset": int64(1), "returned": int64(0), "totalLines": int64(5),
+				"totalBytes": int64(34), "hasMore": true, "nextOffset": int64(1),
+				"truncated": true, "responseBytes": int64(4), "omittedBytes": int64(23),
+				"hint": "line 1 is longer than the response limit, call readFromFile with unit=bytes and offset=7 to read it",
+			},
+		},
+		{
+			name:          "bytes cut at maxBytes",
+			path:          filePath,
+			unit:          readUnitBytes,
+			offset:        7,
+			maxBytes:      10,
+			expectContent: "line 2\nlin",
+			expectMetadata: map[string]any{
+				"unit": "bytes", "offset": int64(7), "returned": int64(10), "totalLines": int64(5),
+				"totalBytes": int64(34), "hasMore": true, "nextOffset": int64(17),
+				"truncated": true, "responseBytes": int64(10), "omittedBytes": int64(17),
+				"hint": "call readFromFile again with unit=bytes and offset=17 to read the rest",
+			},
+		},
+		{
+			name:          "invalid unit",
+			path:          filePath,
+			unit:          "words",
+			expectMessage: `invalid unit "words", must be lines or bytes`,
+		},
+		{
+			name:          "path is directory",
+			path:          tmpDir,
+			unit:          readUnitLines,
+			expectMessage: "path is a directory, must be a file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationResult := readFileRange(root, tt.path, tt.unit, tt.offset, tt.limit, tt.maxBytes)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+
+			if operationResult.Message != tt.expectMessage {
+				t.Errorf("Got %s, expected: %s", operationResult.Message, tt.expectMessage)
+			}
+			if operationResult.Content != tt.expectContent {
+				t.Errorf("Got %q, expected: %q", operationResult.Content, tt.expectContent)
+			}
+			if tt.expectMetadata != nil {
+				// The hash covers the whole file, whatever the range read
+				data, err := os.ReadFile(tt.path)
+				if err != nil {
+					t.Fatalf("Failed to read test file: %v", err)
+				}
+				if operationResult.Metadata["hash"] != contentHash(data) {
+					t.Errorf("Got hash %v, expected: %s", operationResult.Metadata["hash"], contentHash(data))
+				}
+				delete(operationResult.Metadata, "hash")
+				if !reflect.DeepEqual(operationResult.Metadata, tt.expectMetadata) {
+					t.Errorf("Got metadata %v, expected: %v", operationResult.Metadata, tt.expectMetadata)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		maxSize int
+		expect  string
+	}{
+		{
+			name:    "cut at the end of a line",
+			text:    "line 1\nline 2\nline 3\n",
+			maxSize: 16,
+			expect:  "line 1\nline 2\n",
+		},
+		{
+			name:    "no line end in the second half",
+			text:    "a\nlong line without end",
+			maxSize: 10,
+			expect:  "a\nlong lin",
+		},
+		{
+			name:    "cut between UTF-8 characters",
+			text:    "ééééé",
+			maxSize: 5,
+			expect:  "éé",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateText(tt.text, tt.maxSize)
+			if got != tt.expect {
+				t.Errorf("Got %q, expected: %q", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestEditFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	filePath := filepath.Join(tmpDir, "file.go")
+	original := "package main\n\nfunc a() {}\n\nfunc b() {}\n\nfunc a2() {}\n"
+
+	tests := []struct {
+		name          string
+		edits         []textEdit
+		expectMessage string
+		expectContent string
+		expectFile    string
+	}{
+		{
+			name:  "single replacement",
+			edits: []textEdit{{oldText: "func b() {}", newText: "func c() {}"}},
+			expectContent: "--- " + filePath + "\n+++ " + filePath + "\n" +
+				"@@ -2,6 +2,6 @@\n \n func a() {}\n \n-func b() {}\n+func c() {}\n \n func a2() {}\n",
+			expectFile: "package main\n\nfunc a() {}\n\nfunc c() {}\n\nfunc a2() {}\n",
+		},
+		{
+			name:          "ambiguous text",
+			edits:         []textEdit{{oldText: "func a", newText: "func x"}},
+			expectMessage: fmt.Sprintf("edit 1: oldText found 2 times in %s, add surrounding lines to make it unique or set replaceAll", filePath),
+			expectFile:    original,
+		},
+		{
+			name:       "ambiguous text with replaceAll",
+			edits:      []textEdit{{oldText: "func a", newText: "func x", replaceAll: true}},
+			expectFile: "package main\n\nfunc x() {}\n\nfunc b() {}\n\nfunc x2() {}\n",
+		},
+		{
+			name: "missing text leaves the file untouched",
+			edits: []textEdit{
+				{oldText: "func b() {}", newText: "func c() {}"},
+				{oldText: "func d() {}", newText: "func e() {}"},
+			},
+			expectMessage: fmt.Sprintf("edit 2: oldText not found in %s", filePath),
+			expectFile:    original,
+		},
+		{
+			name: "edits applied in order",
+			edits: []textEdit{
+				{oldText: "func b() {}", newText: "func c() {}"},
+				{oldText: "func c() {}", newText: "func d() {}"},
+			},
+			expectFile: "package main\n\nfunc a() {}\n\nfunc d() {}\n\nfunc a2() {}\n",
+		},
+		{
+			name:          "no change",
+			edits:         []textEdit{{oldText: "func b() {}", newText: "func b() {}"}},
+			expectContent: "no changes made, the file already has this content",
+			expectFile:    original,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(filePath, []byte(original), 0640); err != nil {
+				t.Fatalf("Failed to write test file: %v", err)
+			}
+
+			operationResult := editFile(root, filePath, tt.edits)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+			if operationResult.Message != tt.expectMessage {
+				t.Errorf("Got %s, expected: %s", operationResult.Message, tt.expectMessage)
+			}
+			if tt.expectContent != "" && operationResult.Content != tt.expectContent {
+				t.Errorf("Got %q, expected: %q", operationResult.Content, tt.expectContent)
+			}
+
+			content, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatalf("Failed to read test file: %v", err)
+			}
+			if string(content) != tt.expectFile {
+				t.Errorf("Got file %q, expected: %q", content, tt.expectFile)
+			}
+			info, err := os.Stat(filePath)
+			if err != nil {
+				t.Fatalf("Failed to stat test file: %v", err)
+			}
+			if info.Mode().Perm() != 0640 {
+				t.Errorf("Got mode %v, expected: %v", info.Mode().Perm(), os.FileMode(0640))
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to read test directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the edited file to be left, got %d entries", len(entries))
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	target := func(patch string, oldName, newName string) patchTarget {
+		patches, err := parsePatch(patch)
+		if err != nil {
+			t.Fatalf("Failed to parse patch: %v", err)
+		}
+		resolved := patchTarget{patch: patches[0], root: root}
+		if oldName != "" {
+			resolved.oldPath = filepath.Join(tmpDir, oldName)
+		}
+		if newName != "" {
+			resolved.newPath = filepath.Join(tmpDir, newName)
+		}
+		return resolved
+	}
+	modifyA := "--- a/a.txt\n+++ b/a.txt\n@@ -1,2 +1,2 @@\n one\n-two\n+TWO\n"
+	modifyB := "--- a/b.txt\n+++ b/b.txt\n@@ -1 +1 @@\n-three\n+THREE\n"
+	badB := "--- a/b.txt\n+++ b/b.txt\n@@ -1 +1 @@\n-missing\n+THREE\n"
+	createC := "--- /dev/null\n+++ b/dir/c.txt\n@@ -0,0 +1 @@\n+new\n"
+	deleteB := "--- a/b.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-three\n"
+	renameA := "--- a/a.txt\n+++ b/d.txt\n@@ -1,2 +1,2 @@\n one\n-two\n+TWO\n"
+
+	tests := []struct {
+		name          string
+		targets       func() []patchTarget
+		expectMessage bool
+		expectFiles   map[string]string
+	}{
+		{
+			name: "several files",
+			targets: func() []patchTarget {
+				return []patchTarget{target(modifyA, "a.txt", "a.txt"), target(modifyB, "b.txt", "b.txt")}
+			},
+			expectFiles: map[string]string{"a.txt": "one\nTWO\n", "b.txt": "THREE\n"},
+		},
+		{
+			name: "rejected hunk leaves every file untouched",
+			targets: func() []patchTarget {
+				return []patchTarget{target(modifyA, "a.txt", "a.txt"), target(badB, "b.txt", "b.txt")}
+			},
+			expectMessage: true,
+			expectFiles:   map[string]string{"a.txt": "one\ntwo\n", "b.txt": "three\n"},
+		},
+		{
+			name: "create, delete and rename files",
+			targets: func() []patchTarget {
+				return []patchTarget{target(createC, "", "dir/c.txt"), target(deleteB, "b.txt", ""), target(renameA, "a.txt", "d.txt")}
+			},
+			expectFiles: map[string]string{"dir/c.txt": "new\n", "b.txt": "", "a.txt": "", "d.txt": "one\nTWO\n"},
+		},
+		{
+			name: "created file already exists",
+			targets: func() []patchTarget {
+				return []patchTarget{target(strings.Replace(createC, "dir/c.txt", "a.txt", 1), "", "a.txt")}
+			},
+			expectMessage: true,
+			expectFiles:   map[string]string{"a.txt": "one\ntwo\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.RemoveAll(filepath.Join(tmpDir, "dir"))
+			os.Remove(filepath.Join(tmpDir, "d.txt"))
+			if err := os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("one\ntwo\n"), 0644); err != nil {
+				t.Fatalf("Failed to write test file: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(tmpDir, "b.txt"), []byte("three\n"), 0644); err != nil {
+				t.Fatalf("Failed to write test file: %v", err)
+			}
+
+			operationResult := applyPatch(tt.targets(), defaultFilePerms)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+			if tt.expectMessage && operationResult.Message == "" {
+				t.Errorf("Expected the patch to be rejected, got: %s", operationResult.Content)
+			}
+			if !tt.expectMessage && operationResult.Message != "" {
+				t.Errorf("Expected the patch to be applied, got: %s", operationResult.Message)
+			}
+
+			for name, expect := range tt.expectFiles {
+				content, err := os.ReadFile(filepath.Join(tmpDir, name))
+				if expect == "" {
+					if !os.IsNotExist(err) {
+						t.Errorf("Expected %s to be deleted", name)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Failed to read %s: %v", name, err)
+				}
+				if string(content) != expect {
+					t.Errorf("Got %s content %q, expected: %q", name, content, expect)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckFileHash(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	filePath := filepath.Join(tmpDir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("first version"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	readHash := readFile(root, filePath, 0).Metadata["hash"].(string)
+	if info := getFileInfo(context.Background(), root, filePath, false, nil); !strings.Contains(info.Content, "Hash: "+readHash) {
+		t.Errorf("Expected file info to have the hash %s, got: %s", readHash, info.Content)
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		change        func()
+		expectErr     bool
+		expectMessage string
+	}{
+		{
+			name: "unchanged file",
+			path: filePath,
+		},
+		{
+			name:          "directory",
+			path:          tmpDir,
+			expectMessage: "expectedHash can only be checked on a file",
+		},
+		{
+			name: "changed file",
+			path: filePath,
+			change: func() {
+				if err := os.WriteFile(filePath, []byte("second version"), 0644); err != nil {
+					t.Fatalf("Failed to write test file: %v", err)
+				}
+			},
+			expectErr: true,
+		},
+		{
+			name: "removed file",
+			path: filePath,
+			change: func() {
+				if err := os.Remove(filePath); err != nil {
+					t.Fatalf("Failed to remove test file: %v", err)
+				}
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.change != nil {
+				tt.change()
+			}
+
+			operationResult := checkFileHash(root, tt.path, readHash)
+			if tt.expectErr {
+				if !errors.Is(operationResult.Error, errHashConflict) {
+					t.Errorf("Expected a conflict error, got: %v", operationResult.Error)
+				}
+				return
+			}
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+			if operationResult.Message != tt.expectMessage {
+				t.Errorf("Got %s, expected: %s", operationResult.Message, tt.expectMessage)
+			}
+		})
+	}
+}
+
+func TestAppendToFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	logPath := filepath.Join(tmpDir, "app.log")
+	if err := os.WriteFile(logPath, []byte("first"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		content       string
+		ensureNewline bool
+		expectFile    string
+		expectMessage string
+	}{
+		{
+			name:       "append as is",
+			path:       logPath,
+			content:    " entry",
+			expectFile: "first entry",
+		},
+		{
+			name:          "append on a new line",
+			path:          logPath,
+			content:       "second entry",
+			ensureNewline: true,
+			expectFile:    "first entry\nsecond entry\n",
+		},
+		{
+			name:          "file already ends with a newline",
+			path:          logPath,
+			content:       "third entry\n",
+			ensureNewline: true,
+			expectFile:    "first entry\nsecond entry\nthird entry\n",
+		},
+		{
+			name:          "create the file and its parents",
+			path:          filepath.Join(tmpDir, "logs", "new.log"),
+			content:       "entry",
+			ensureNewline: true,
+			expectFile:    "entry\n",
+		},
+		{
+			name:          "path is directory",
+			path:          tmpDir,
+			content:       "entry",
+			expectMessage: "path is a directory, must be a file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationResult := appendToFile(root, tt.content, tt.path, tt.ensureNewline, defaultFilePerms)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+			if operationResult.Message != tt.expectMessage {
+				t.Errorf("Got %s, expected: %s", operationResult.Message, tt.expectMessage)
+			}
+			if tt.expectMessage != "" {
+				return
+			}
+
+			content, err := os.ReadFile(tt.path)
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", tt.path, err)
+			}
+			if string(content) != tt.expectFile {
+				t.Errorf("Got %q, expected: %q", content, tt.expectFile)
+			}
+		})
+	}
+
+	// A path under a regular file fails to stat with ENOTDIR, which must be reported and not crash
+	operationResult := appendToFile(root, "entry", filepath.Join(logPath, "x.log"), true, defaultFilePerms)
+	if operationResult.Error == nil || !strings.Contains(operationResult.Error.Error(), "not a directory") {
+		t.Errorf("Expected a not a directory error, got %v %q", operationResult.Error, operationResult.Message)
+	}
+
+	info, err := os.Stat(filepath.Join(tmpDir, "logs", "new.log"))
+	if err != nil {
+		t.Fatalf("Failed to stat the created file: %v", err)
+	}
+	if info.Mode().Perm() != defaultFilePerms.file {
+		t.Errorf("Got mode %v, expected: %v", info.Mode().Perm(), defaultFilePerms.file)
+	}
+}
+
+func TestInsertAndDeleteLines(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	filePath := filepath.Join(tmpDir, "file.txt")
+	binaryPath := filepath.Join(tmpDir, "file.bin")
+	if err := os.WriteFile(binaryPath, []byte{0xff, 0xfe, 0x00}, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	original := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight"
+
+	tests := []struct {
+		name          string
+		path          string
+		operation     func(path string) OperationResult
+		expectMessage string
+		expectContent string
+		expectFile    string
+	}{
+		{
+			name:          "insert after a line",
+			path:          filePath,
+			operation:     func(path string) OperationResult { return insertLines(root, path, 4, "new 1\nnew 2") },
+			expectContent: "inserted 2 lines after line 4, lines around them are now:\n2: two\n3: three\n4: four\n5: new 1\n6: new 2\n7: five\n8: six\n9: seven\n",
+			expectFile:    "one\ntwo\nthree\nfour\nnew 1\nnew 2\nfive\nsix\nseven\neight",
+		},
+		{
+			name:       "insert at the start",
+			path:       filePath,
+			operation:  func(path string) OperationResult { return insertLines(root, path, 0, "zero\n") },
+			expectFile: "zero\none\ntwo\nthree\nfour\nfive\nsix\nseven\neight",
+		},
+		{
+			name:       "insert at the end of a file without a final newline",
+			path:       filePath,
+			operation:  func(path string) OperationResult { return insertLines(root, path, 8, "nine\n") },
+			expectFile: "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\n",
+		},
+		{
+			name:          "insert out of range",
+			path:          filePath,
+			operation:     func(path string) OperationResult { return insertLines(root, path, 9, "nine") },
+			expectMessage: "line 9 is out of range, the file has 8 lines",
+			expectFile:    original,
+		},
+		{
+			name:          "delete a range",
+			path:          filePath,
+			operation:     func(path string) OperationResult { return deleteLines(root, path, 3, 5) },
+			expectContent: "deleted lines 3 to 5, lines around them are now:\n1: one\n2: two\n3: six\n4: seven\n5: eight\n",
+			expectFile:    "one\ntwo\nsix\nseven\neight",
+		},
+		{
+			name:       "delete the last line",
+			path:       filePath,
+			operation:  func(path string) OperationResult { return deleteLines(root, path, 8, 8) },
+			expectFile: "one\ntwo\nthree\nfour\nfive\nsix\nseven\n",
+		},
+		{
+			name:          "delete out of range",
+			path:          filePath,
+			operation:     func(path string) OperationResult { return deleteLines(root, path, 7, 9) },
+			expectMessage: "lines 7 to 9 are out of range, the file has 8 lines",
+			expectFile:    original,
+		},
+		{
+			name:          "binary file",
+			path:          binaryPath,
+			operation:     func(path string) OperationResult { return deleteLines(root, path, 1, 1) },
+			expectMessage: "file is not valid UTF-8 text (likely binary)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(filePath, []byte(original), 0644); err != nil {
+				t.Fatalf("Failed to write test file: %v", err)
+			}
+
+			operationResult := tt.operation(tt.path)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+			if operationResult.Message != tt.expectMessage {
+				t.Errorf("Got %s, expected: %s", operationResult.Message, tt.expectMessage)
+			}
+			if tt.expectContent != "" && operationResult.Content != tt.expectContent {
+				t.Errorf("Got %q, expected: %q", operationResult.Content, tt.expectContent)
+			}
+
+			if tt.expectFile != "" {
+				content, err := os.ReadFile(tt.path)
+				if err != nil {
+					t.Fatalf("Failed to read test file: %v", err)
+				}
+				if string(content) != tt.expectFile {
+					t.Errorf("Got file %q, expected: %q", content, tt.expectFile)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	files := map[string]string{
+		"main.go":                  "package main",
+		"README.md":                "# readme",
+		"src/app/app.go":           "package app",
+		"src/app/app_test.go":      "package app",
+		"src/lib/big.go":           strings.Repeat("x", 2048),
+		"vendor/module/vendor.go":  "package module",
+		"docs/Application-Note.md": "notes",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(tmpDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatalf("Failed to create test directory: %v", err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(tmpDir, "main.go"), old, old); err != nil {
+		t.Fatalf("Failed to change test file times: %v", err)
+	}
+
+	skipVendor := func(path string, entry os.DirEntry) bool { return entry.Name() != "vendor" }
+
+	tests := []struct {
+		name          string
+		search        fileSearch
+		filter        entryFilter
+		expect        []string
+		expectHasMore bool
+	}{
+		{
+			name:   "name glob at any depth",
+			search: fileSearch{pattern: "*_test.go"},
+			expect: []string{"src/app/app_test.go"},
+		},
+		{
+			name:   "path glob",
+			search: fileSearch{pattern: "src/**/*.go"},
+			expect: []string{"src/app/app.go", "src/app/app_test.go", "src/lib/big.go"},
+		},
+		{
+			name:   "name substring ignoring case",
+			search: fileSearch{name: "app"},
+			expect: []string{"docs/Application-Note.md", "src/app", "src/app/app.go", "src/app/app_test.go"},
+		},
+		{
+			name:   "regex and type",
+			search: fileSearch{regex: regexp.MustCompile(`^src/[^/]+$`), entryType: entryTypeDirectory},
+			expect: []string{"src/app", "src/lib"},
+		},
+		{
+			name:   "minimum size",
+			search: fileSearch{minSize: 1024},
+			expect: []string{"src/lib/big.go"},
+		},
+		{
+			name:   "modified before",
+			search: fileSearch{modifiedBefore: time.Now().Add(-24 * time.Hour)},
+			expect: []string{"main.go"},
+		},
+		{
+			name:   "filtered directories are not searched",
+			search: fileSearch{pattern: "*.go"},
+			filter: skipVendor,
+			expect: []string{"main.go", "src/app/app.go", "src/app/app_test.go", "src/lib/big.go"},
+		},
+		{
+			name:          "max results",
+			search:        fileSearch{pattern: "*.go", maxResults: 2},
+			filter:        skipVendor,
+			expect:        []string{"main.go", "src/app/app.go"},
+			expectHasMore: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationResult := searchFiles(context.Background(), root, tmpDir, tt.search, tt.filter)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+
+			got := []string{}
+			for _, line := range strings.Split(strings.TrimSpace(operationResult.Content), "\n") {
+				if line == "" {
+					continue
+				}
+				entryPath, _, _ := strings.Cut(strings.TrimPrefix(line, "- "), " (")
+				relPath, _ := filepath.Rel(tmpDir, entryPath)
+				got = append(got, filepath.ToSlash(relPath))
+			}
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("Got %v, expected: %v", got, tt.expect)
+			}
+			if hasMore, _ := operationResult.Metadata["hasMore"].(bool); hasMore != tt.expectHasMore {
+				t.Errorf("Got hasMore %v, expected: %v", hasMore, tt.expectHasMore)
+			}
+		})
+	}
+
+	if operationResult := searchFiles(context.Background(), root, tmpDir, fileSearch{name: "missing"}, nil); operationResult.Message != "no entries found under "+tmpDir {
+		t.Errorf("Expected no entries to be found, got: %+v", operationResult)
+	}
+}
+
+func TestGrepContent(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	files := map[string]string{
+		"a.go":       "package main\n\nfunc main() {\n\tprintln(\"héllo\", \"hello\")\n}\n",
+		"b.txt":      "one\ntwo\nthree\nfour\nfive\nsix\nseven\nhello\n",
+		"sub/c.go":   "package sub\n\n// Hello is unused\n",
+		"binary.bin": "hello\x00\x01\x02\xff",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(tmpDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatalf("Failed to create test directory: %v", err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+	aPath := filepath.Join(tmpDir, "a.go")
+	bPath := filepath.Join(tmpDir, "b.txt")
+	cPath := filepath.Join(tmpDir, "sub", "c.go")
+
+	tests := []struct {
+		name          string
+		path          string
+		search        contentSearch
+		expect        string
+		expectMessage string
+		expectHasMore bool
+	}{
+		{
+			name:   "matches with columns in characters",
+			path:   tmpDir,
+			search: contentSearch{regex: regexp.MustCompile(`hello`)},
+			expect: fmt.Sprintf("%s:4:20: \tprintln(\"héllo\", \"hello\")\n%s:8:1: hello\n", aPath, bPath),
+		},
+		{
+			name:   "include glob and case-insensitive pattern",
+			path:   tmpDir,
+			search: contentSearch{regex: regexp.MustCompile(`(?i)hello`), include: "*.go"},
+			expect: fmt.Sprintf("%s:4:20: \tprintln(\"héllo\", \"hello\")\n%s:3:4: // Hello is unused\n", aPath, cPath),
+		},
+		{
+			name:   "context lines",
+			path:   bPath,
+			search: contentSearch{regex: regexp.MustCompile(`^(two|seven)$`), contextLines: 1},
+			expect: fmt.Sprintf("%[1]s-1- one\n%[1]s:2:1: two\n%[1]s-3- three\n--\n%[1]s-6- six\n%[1]s:7:1: seven\n%[1]s-8- hello\n", bPath),
+		},
+		{
+			name:          "max results",
+			path:          bPath,
+			search:        contentSearch{regex: regexp.MustCompile(`e`), maxResults: 2},
+			expect:        fmt.Sprintf("%[1]s:1:3: one\n%[1]s:3:4: three\n", bPath),
+			expectHasMore: true,
+		},
+		{
+			name:          "no match",
+			path:          tmpDir,
+			search:        contentSearch{regex: regexp.MustCompile(`missing`)},
+			expectMessage: fmt.Sprintf("no matches found in 3 files under %s", tmpDir),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationResult := grepContent(context.Background(), root, tt.path, tt.search, nil)
+			if operationResult.Error != nil {
+				t.Fatalf("unexpected error: %v", operationResult.Error)
+			}
+			if operationResult.Message != tt.expectMessage {
+				t.Errorf("Got %s, expected: %s", operationResult.Message, tt.expectMessage)
+			}
+			if operationResult.Content != tt.expect {
+				t.Errorf("Got:\n%s\nexpected:\n%s", operationResult.Content, tt.expect)
+			}
+			if hasMore, _ := operationResult.Metadata["hasMore"].(bool); hasMore != tt.expectHasMore {
+				t.Errorf("Got hasMore %v, expected: %v", hasMore, tt.expectHasMore)
+			}
+		})
+	}
 }
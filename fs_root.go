@@ -0,0 +1,529 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// fsRoot is a handle to a base directory, opened once at startup. Every file system operation goes
+// through it, so path resolution is confined to the directory by the kernel (openat with the root
+// descriptor) instead of by string prefixes, and a path swapped for a symlink between the check in
+// isSafePath and the actual operation can no longer escape.
+//
+// os.Root refuses to follow a link with an absolute target, even one pointing back inside the base
+// directory, so the links along a path are resolved by the root itself before each call and links
+// staying inside it are followed like any other (see resolve).
+//
+// The symlinkFollowAnywhere policy explicitly allows links to leave the base directory, so in that
+// case operations fall back to regular path based calls.
+//
+// A root can be mounted read-only, in which case every method that would modify it fails.
+type fsRoot struct {
+	name     string
+	dir      string
+	root     *os.Root
+	policy   symlinkPolicy
+	readOnly bool
+}
+
+// rootSpec describes a root directory as given in the -dir flag
+type rootSpec struct {
+	name     string
+	dir      string
+	readOnly bool
+}
+
+// parseRootSpec parses a root in the format [name=]path[:ro|:rw]. The name defaults to the last element
+// of the path and the mode defaults to read-write.
+func parseRootSpec(value string) (rootSpec, error) {
+	spec := rootSpec{}
+	dir := value
+
+	if name, rest, found := strings.Cut(dir, "="); found && !strings.ContainsRune(name, filepath.Separator) {
+		spec.name = name
+		dir = rest
+	}
+
+	switch {
+	case strings.HasSuffix(dir, ":ro"):
+		spec.readOnly = true
+		dir = strings.TrimSuffix(dir, ":ro")
+	case strings.HasSuffix(dir, ":rw"):
+		dir = strings.TrimSuffix(dir, ":rw")
+	}
+
+	if dir == "" {
+		return rootSpec{}, fmt.Errorf("missing directory in %q", value)
+	}
+	spec.dir = dir
+
+	if spec.name == "" {
+		spec.name = filepath.Base(filepath.Clean(dir))
+	}
+
+	return spec, nil
+}
+
+func openRoot(spec rootSpec, policy symlinkPolicy) (*fsRoot, error) {
+	absDir, err := filepath.Abs(spec.dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(absDir)
+	if err != nil {
+		return nil, err
+	}
+
+	name := spec.name
+	if name == "" {
+		name = filepath.Base(absDir)
+	}
+	return &fsRoot{name: name, dir: absDir, root: root, policy: policy, readOnly: spec.readOnly}, nil
+}
+
+// findRoot returns the root a path belongs to, along with the path to use inside of it. Paths can either
+// be absolute, where the innermost root containing them wins, or start with the name of a root.
+func findRoot(roots []*fsRoot, path string) (*fsRoot, string, bool) {
+	if !filepath.IsAbs(path) {
+		first, rest, _ := strings.Cut(filepath.ToSlash(filepath.Clean(path)), "/")
+		for _, root := range roots {
+			if root.name == first {
+				return root, filepath.Join(root.dir, filepath.FromSlash(rest)), true
+			}
+		}
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", false
+	}
+
+	var found *fsRoot
+	for _, root := range roots {
+		if isWithin(root.dir, absPath) && (found == nil || len(root.dir) > len(found.dir)) {
+			found = root
+		}
+	}
+	return found, path, found != nil
+}
+
+func (r *fsRoot) Close() error {
+	return r.root.Close()
+}
+
+// rel converts a path given by the client into a path relative to the root directory
+func (r *fsRoot) rel(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if !isWithin(r.dir, absPath) {
+		return "", fmt.Errorf("path %s is outside of %s", path, r.dir)
+	}
+	rel, err := filepath.Rel(r.dir, absPath)
+	if err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+// maxLinkHops bounds the links resolve follows, as the kernel does with ELOOP
+const maxLinkHops = 40
+
+// rootPath converts a path given by the client into the path to hand to os.Root. The symlinks along it
+// are resolved when they stay inside the root, and so is the last element when follow is set. A link
+// leaving the root is kept as it is, for os.Root to refuse it.
+func (r *fsRoot) rootPath(path string, follow bool) (string, error) {
+	name, err := r.rel(path)
+	if err != nil || r.unconfined() {
+		return name, err
+	}
+	return r.resolve(name, follow), nil
+}
+
+// resolve rewrites the symlinks of a path relative to the root into the relative paths they point to,
+// stopping at the first link that leaves the root
+func (r *fsRoot) resolve(name string, follow bool) string {
+	resolved, rest := ".", name
+	for hops := 0; rest != ""; {
+		part, remaining, _ := strings.Cut(rest, string(filepath.Separator))
+		next := filepath.Join(resolved, part)
+		info, err := r.root.Lstat(next)
+		if err != nil {
+			return filepath.Join(next, remaining)
+		}
+		if info.Mode()&os.ModeSymlink == 0 || (remaining == "" && !follow) || hops == maxLinkHops {
+			resolved, rest = next, remaining
+			continue
+		}
+
+		target, err := r.linkTarget(next)
+		if err != nil {
+			return filepath.Join(next, remaining)
+		}
+		resolved, rest = ".", filepath.Join(target, remaining)
+		hops++
+	}
+	return resolved
+}
+
+// linkTarget returns the path relative to the root that the link at name points to, whether its target
+// is relative or absolute, or an error when it leaves the root
+func (r *fsRoot) linkTarget(name string) (string, error) {
+	target, err := r.root.Readlink(name)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(name), target)
+	} else if isWithin(r.dir, target) {
+		target, err = filepath.Rel(r.dir, target)
+	} else if realDir, evalErr := filepath.EvalSymlinks(r.dir); evalErr == nil && isWithin(realDir, target) {
+		target, err = filepath.Rel(realDir, target)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsLocal(target) {
+		return "", fmt.Errorf("link %s leaves %s", name, r.dir)
+	}
+	return target, nil
+}
+
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (n namedFileInfo) Name() string {
+	return n.name
+}
+
+func (r *fsRoot) unconfined() bool {
+	return r.policy == symlinkFollowAnywhere
+}
+
+var errReadOnlyRoot = errors.New("root is mounted read-only")
+
+func (r *fsRoot) checkWritable(op, path string) error {
+	if r.readOnly {
+		return &os.PathError{Op: op, Path: path, Err: errReadOnlyRoot}
+	}
+	return nil
+}
+
+func (r *fsRoot) Stat(path string) (os.FileInfo, error) {
+	name, err := r.rootPath(path, true)
+	if err != nil {
+		return nil, err
+	}
+	if r.unconfined() {
+		return os.Stat(filepath.Join(r.dir, name))
+	}
+	info, err := r.root.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "." {
+		// os.Root reports the root directory itself as ".", keep the real directory name instead
+		return namedFileInfo{FileInfo: info, name: filepath.Base(r.dir)}, nil
+	}
+	return info, nil
+}
+
+func (r *fsRoot) Lstat(path string) (os.FileInfo, error) {
+	name, err := r.rootPath(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if r.unconfined() {
+		return os.Lstat(filepath.Join(r.dir, name))
+	}
+	return r.root.Lstat(name)
+}
+
+func (r *fsRoot) Readlink(path string) (string, error) {
+	name, err := r.rootPath(path, false)
+	if err != nil {
+		return "", err
+	}
+	if r.unconfined() {
+		return os.Readlink(filepath.Join(r.dir, name))
+	}
+	return r.root.Readlink(name)
+}
+
+func (r *fsRoot) Open(path string) (*os.File, error) {
+	return r.OpenFile(path, os.O_RDONLY, 0)
+}
+
+func (r *fsRoot) Create(path string) (*os.File, error) {
+	return r.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (r *fsRoot) OpenFile(path string, flag int, perm fs.FileMode) (*os.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if err := r.checkWritable("open", path); err != nil {
+			return nil, err
+		}
+	}
+	name, err := r.rootPath(path, flag&os.O_EXCL == 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.unconfined() {
+		return os.OpenFile(filepath.Join(r.dir, name), flag, perm) // #nosec G304
+	}
+	return r.root.OpenFile(name, flag, perm)
+}
+
+func (r *fsRoot) ReadDir(path string) ([]os.DirEntry, error) {
+	dir, err := r.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(entries, func(a, b os.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (r *fsRoot) ReadFile(path string) ([]byte, error) {
+	name, err := r.rootPath(path, true)
+	if err != nil {
+		return nil, err
+	}
+	if r.unconfined() {
+		return os.ReadFile(filepath.Join(r.dir, name)) // #nosec G304
+	}
+	return r.root.ReadFile(name)
+}
+
+func (r *fsRoot) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	if err := r.checkWritable("write", path); err != nil {
+		return err
+	}
+	name, err := r.rootPath(path, true)
+	if err != nil {
+		return err
+	}
+	if r.unconfined() {
+		return os.WriteFile(filepath.Join(r.dir, name), data, perm)
+	}
+	return r.root.WriteFile(name, data, perm)
+}
+
+// hiddenSibling returns a random hidden path in the directory of path, such as .name.tmp-1234, to stage
+// changes that are then renamed over path
+func hiddenSibling(path, kind string) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%s-%d", filepath.Base(path), kind, rand.Uint32()))
+}
+
+// WriteFileAtomic writes data to a temporary file in the same directory, syncs it to disk and renames it
+// over path, so readers only ever see the old contents or the complete new ones. The file ends up with
+// exactly the given permissions.
+//
+// When path is a symlink, its target is replaced and the link is kept, as a regular write does. A target
+// outside of the root, only reachable with the symlinkFollowAnywhere policy, is written in place.
+func (r *fsRoot) WriteFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	if err := r.checkWritable("write", path); err != nil {
+		return err
+	}
+
+	if info, err := r.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		realDir, err := filepath.EvalSymlinks(r.dir)
+		if err != nil {
+			return err
+		}
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+		if !isWithin(realDir, target) {
+			return r.WriteFile(path, data, perm)
+		}
+		rel, err := filepath.Rel(realDir, target)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(r.dir, rel)
+	}
+
+	var tmp *os.File
+	var tmpPath string
+	for {
+		tmpPath = hiddenSibling(path, "tmp")
+		var err error
+		tmp, err = r.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+
+	err := func() error {
+		defer tmp.Close()
+		if _, err := tmp.Write(data); err != nil {
+			return err
+		}
+		if err := tmp.Chmod(perm); err != nil {
+			return err
+		}
+		if err := tmp.Sync(); err != nil {
+			return err
+		}
+		return tmp.Close()
+	}()
+	if err == nil {
+		err = r.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = r.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Mkdir creates a directory. Unlike os.Mkdir, the directory gets exactly perm, whatever the umask.
+func (r *fsRoot) Mkdir(path string, perm fs.FileMode) error {
+	if err := r.checkWritable("mkdir", path); err != nil {
+		return err
+	}
+	name, err := r.rootPath(path, false)
+	if err != nil {
+		return err
+	}
+	if r.unconfined() {
+		err = os.Mkdir(filepath.Join(r.dir, name), perm)
+	} else {
+		err = r.root.Mkdir(name, perm)
+	}
+	if err != nil {
+		return err
+	}
+	return r.Chmod(path, perm)
+}
+
+// MkdirAll creates a directory along with its missing parents. Unlike os.MkdirAll, every directory it
+// creates gets exactly perm, whatever the umask, while existing ones are left as they are.
+func (r *fsRoot) MkdirAll(path string, perm fs.FileMode) error {
+	if err := r.checkWritable("mkdir", path); err != nil {
+		return err
+	}
+	name, err := r.rootPath(path, true)
+	if err != nil {
+		return err
+	}
+
+	// The directories missing, from the deepest one up
+	missing := []string{}
+	for current := filepath.Clean(path); ; current = filepath.Dir(current) {
+		if _, err := r.Stat(current); !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, current)
+	}
+
+	if r.unconfined() {
+		err = os.MkdirAll(filepath.Join(r.dir, name), perm)
+	} else {
+		err = r.root.MkdirAll(name, perm)
+	}
+	if err != nil {
+		return err
+	}
+	for _, dir := range missing {
+		if err := r.Chmod(dir, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *fsRoot) Rename(oldPath, newPath string) error {
+	if err := r.checkWritable("rename", oldPath); err != nil {
+		return err
+	}
+	oldName, err := r.rootPath(oldPath, false)
+	if err != nil {
+		return err
+	}
+	newName, err := r.rootPath(newPath, false)
+	if err != nil {
+		return err
+	}
+	if r.unconfined() {
+		return os.Rename(filepath.Join(r.dir, oldName), filepath.Join(r.dir, newName))
+	}
+	return r.root.Rename(oldName, newName)
+}
+
+func (r *fsRoot) Remove(path string) error {
+	if err := r.checkWritable("remove", path); err != nil {
+		return err
+	}
+	name, err := r.rootPath(path, false)
+	if err != nil {
+		return err
+	}
+	if r.unconfined() {
+		return os.Remove(filepath.Join(r.dir, name))
+	}
+	return r.root.Remove(name)
+}
+
+func (r *fsRoot) RemoveAll(path string) error {
+	if err := r.checkWritable("remove", path); err != nil {
+		return err
+	}
+	name, err := r.rootPath(path, false)
+	if err != nil {
+		return err
+	}
+	if r.unconfined() {
+		return os.RemoveAll(filepath.Join(r.dir, name))
+	}
+	return r.root.RemoveAll(name)
+}
+
+func (r *fsRoot) Symlink(target, path string) error {
+	if err := r.checkWritable("symlink", path); err != nil {
+		return err
+	}
+	name, err := r.rootPath(path, false)
+	if err != nil {
+		return err
+	}
+	if r.unconfined() {
+		return os.Symlink(target, filepath.Join(r.dir, name))
+	}
+	return r.root.Symlink(target, name)
+}
+
+func (r *fsRoot) Chmod(path string, mode fs.FileMode) error {
+	if err := r.checkWritable("chmod", path); err != nil {
+		return err
+	}
+	name, err := r.rootPath(path, true)
+	if err != nil {
+		return err
+	}
+	if r.unconfined() {
+		return os.Chmod(filepath.Join(r.dir, name), mode)
+	}
+	return r.root.Chmod(name, mode)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFsRootConfinement(t *testing.T) {
+	baseDir := t.TempDir()
+	outsideDir := t.TempDir()
+
+	outsideFile := filepath.Join(outsideDir, "secret.txt")
+	if err := os.WriteFile(outsideFile, []byte("secret"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	insideFile := filepath.Join(baseDir, "file.txt")
+	if err := os.WriteFile(insideFile, []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := os.Symlink(outsideDir, filepath.Join(baseDir, "link-outside")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink("file.txt", filepath.Join(baseDir, "link-inside")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	// os.Root refuses absolute link targets, even when they point back inside the root
+	os.MkdirAll(filepath.Join(baseDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(baseDir, "sub", "nested.txt"), []byte("nested"), 0644)
+	links := map[string]string{
+		"abs-file":    insideFile,
+		"abs-dir":     filepath.Join(baseDir, "sub"),
+		"abs-chain":   filepath.Join(baseDir, "link-inside"),
+		"abs-outside": outsideFile,
+		"sub/up":      "../../" + filepath.Base(outsideDir),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(baseDir, name)); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		policy        symlinkPolicy
+		expectContent string
+		expectErr     bool
+	}{
+		{
+			name:          "file inside root",
+			path:          insideFile,
+			expectContent: "test",
+		},
+		{
+			name:          "symlink pointing inside root",
+			path:          filepath.Join(baseDir, "link-inside"),
+			expectContent: "test",
+		},
+		{
+			name:          "absolute symlink pointing inside root",
+			path:          filepath.Join(baseDir, "abs-file"),
+			expectContent: "test",
+		},
+		{
+			name:          "absolute symlink to a directory inside root",
+			path:          filepath.Join(baseDir, "abs-dir", "nested.txt"),
+			expectContent: "nested",
+		},
+		{
+			name:          "absolute symlink to a relative symlink",
+			path:          filepath.Join(baseDir, "abs-chain"),
+			expectContent: "test",
+		},
+		{
+			name:      "absolute symlink pointing outside root",
+			path:      filepath.Join(baseDir, "abs-outside"),
+			expectErr: true,
+		},
+		{
+			name:      "relative symlink climbing out of root",
+			path:      filepath.Join(baseDir, "sub", "up", "secret.txt"),
+			expectErr: true,
+		},
+		{
+			name:      "absolute path outside root",
+			path:      outsideFile,
+			expectErr: true,
+		},
+		{
+			name:      "parent directory traversal",
+			path:      filepath.Join(baseDir, "..", filepath.Base(outsideDir), "secret.txt"),
+			expectErr: true,
+		},
+		{
+			name:      "symlink pointing outside root",
+			path:      filepath.Join(baseDir, "link-outside", "secret.txt"),
+			expectErr: true,
+		},
+		{
+			name:          "symlink pointing outside root with follow-anywhere policy",
+			path:          filepath.Join(baseDir, "link-outside", "secret.txt"),
+			policy:        symlinkFollowAnywhere,
+			expectContent: "secret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := openRoot(rootSpec{dir: baseDir}, tt.policy)
+			if err != nil {
+				t.Fatalf("Failed to open root: %v", err)
+			}
+			defer root.Close()
+
+			content, err := root.ReadFile(tt.path)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("Expected error reading %s, got content %q", tt.path, content)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(content) != tt.expectContent {
+				t.Errorf("Got %q, expected: %q", content, tt.expectContent)
+			}
+		})
+	}
+
+	t.Run("the last link is kept unless followed", func(t *testing.T) {
+		root, err := openRoot(rootSpec{dir: baseDir}, symlinkFollowWithinRoot)
+		if err != nil {
+			t.Fatalf("Failed to open root: %v", err)
+		}
+		defer root.Close()
+
+		if info, err := root.Lstat(filepath.Join(baseDir, "abs-dir")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("Expected Lstat to report the link itself, got %v (%v)", info, err)
+		}
+		if info, err := root.Stat(filepath.Join(baseDir, "abs-dir")); err != nil || !info.IsDir() {
+			t.Errorf("Expected Stat to report the directory, got %v (%v)", info, err)
+		}
+	})
+}
+
+func TestParseRootSpec(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		expect    rootSpec
+		expectErr bool
+	}{
+		{
+			name:   "plain directory",
+			value:  "/home/user/repo",
+			expect: rootSpec{name: "repo", dir: "/home/user/repo"},
+		},
+		{
+			name:   "named directory",
+			value:  "code=/home/user/repo",
+			expect: rootSpec{name: "code", dir: "/home/user/repo"},
+		},
+		{
+			name:   "read-only directory",
+			value:  "/share/docs:ro",
+			expect: rootSpec{name: "docs", dir: "/share/docs", readOnly: true},
+		},
+		{
+			name:   "named read-write directory",
+			value:  "scratch=/tmp/scratch:rw",
+			expect: rootSpec{name: "scratch", dir: "/tmp/scratch"},
+		},
+		{
+			name:   "equal sign inside the path",
+			value:  "/data/a=b",
+			expect: rootSpec{name: "a=b", dir: "/data/a=b"},
+		},
+		{
+			name:      "missing directory",
+			value:     "docs=:ro",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseRootSpec(tt.value)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("Expected error, got %+v", spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if spec != tt.expect {
+				t.Errorf("Got %+v, expected: %+v", spec, tt.expect)
+			}
+		})
+	}
+}
+
+func TestFindRoot(t *testing.T) {
+	repoDir := t.TempDir()
+	nestedDir := filepath.Join(repoDir, "nested")
+	if err := os.Mkdir(nestedDir, 0755); err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+	docsDir := t.TempDir()
+
+	repo, err := openRoot(rootSpec{name: "repo", dir: repoDir}, symlinkFollowWithinRoot)
+	if err != nil {
+		t.Fatalf("Failed to open root: %v", err)
+	}
+	defer repo.Close()
+	nested, err := openRoot(rootSpec{name: "nested", dir: nestedDir}, symlinkFollowWithinRoot)
+	if err != nil {
+		t.Fatalf("Failed to open root: %v", err)
+	}
+	defer nested.Close()
+	docs, err := openRoot(rootSpec{name: "docs", dir: docsDir, readOnly: true}, symlinkFollowWithinRoot)
+	if err != nil {
+		t.Fatalf("Failed to open root: %v", err)
+	}
+	defer docs.Close()
+
+	roots := []*fsRoot{repo, nested, docs}
+
+	tests := []struct {
+		name       string
+		path       string
+		expectRoot *fsRoot
+		expectPath string
+	}{
+		{
+			name:       "absolute path inside a root",
+			path:       filepath.Join(docsDir, "guide.md"),
+			expectRoot: docs,
+			expectPath: filepath.Join(docsDir, "guide.md"),
+		},
+		{
+			name:       "innermost root wins",
+			path:       filepath.Join(nestedDir, "file.txt"),
+			expectRoot: nested,
+			expectPath: filepath.Join(nestedDir, "file.txt"),
+		},
+		{
+			name:       "path starting with a root name",
+			path:       "docs/guide.md",
+			expectRoot: docs,
+			expectPath: filepath.Join(docsDir, "guide.md"),
+		},
+		{
+			name:       "root name alone",
+			path:       "repo",
+			expectRoot: repo,
+			expectPath: repoDir,
+		},
+		{
+			name:       "path outside every root",
+			path:       "/not/a/root/file.txt",
+			expectRoot: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, path, ok := findRoot(roots, tt.path)
+			if tt.expectRoot == nil {
+				if ok {
+					t.Errorf("Expected no root, got %s", root.name)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("Expected root %s, got none", tt.expectRoot.name)
+			}
+			if root != tt.expectRoot {
+				t.Errorf("Got root %s, expected: %s", root.name, tt.expectRoot.name)
+			}
+			if path != tt.expectPath {
+				t.Errorf("Got path %s, expected: %s", path, tt.expectPath)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	baseDir := t.TempDir()
+
+	filePath := filepath.Join(baseDir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	linkPath := filepath.Join(baseDir, "link.txt")
+	if err := os.Symlink("file.txt", linkPath); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		data   string
+		perm   os.FileMode
+		expect string
+	}{
+		{
+			name:   "new file",
+			path:   filepath.Join(baseDir, "new.txt"),
+			data:   "new",
+			perm:   0600,
+			expect: filepath.Join(baseDir, "new.txt"),
+		},
+		{
+			name:   "replace a file",
+			path:   filePath,
+			data:   "replaced",
+			perm:   0755,
+			expect: filePath,
+		},
+		{
+			name:   "replace the target of a symlink",
+			path:   linkPath,
+			data:   "through link",
+			perm:   0644,
+			expect: filePath,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := openRoot(rootSpec{dir: baseDir}, symlinkFollowWithinRoot)
+			if err != nil {
+				t.Fatalf("Failed to open root: %v", err)
+			}
+			defer root.Close()
+
+			if err := root.WriteFileAtomic(tt.path, []byte(tt.data), tt.perm); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			content, err := os.ReadFile(tt.expect)
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", tt.expect, err)
+			}
+			if string(content) != tt.data {
+				t.Errorf("Got %q, expected: %q", content, tt.data)
+			}
+			info, err := os.Stat(tt.expect)
+			if err != nil {
+				t.Fatalf("Failed to stat %s: %v", tt.expect, err)
+			}
+			if info.Mode().Perm() != tt.perm {
+				t.Errorf("Got mode %v, expected: %v", info.Mode().Perm(), tt.perm)
+			}
+			if info, err := os.Lstat(linkPath); err != nil || info.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("Expected %s to still be a symlink", linkPath)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		t.Fatalf("Failed to read test directory: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("Expected no temporary file to be left, got %d entries", len(entries))
+	}
+
+	readOnly, err := openRoot(rootSpec{dir: baseDir, readOnly: true}, symlinkFollowWithinRoot)
+	if err != nil {
+		t.Fatalf("Failed to open root: %v", err)
+	}
+	defer readOnly.Close()
+	if err := readOnly.WriteFileAtomic(filePath, []byte("denied"), 0644); err == nil {
+		t.Errorf("Expected error writing to a read-only root")
+	}
+}
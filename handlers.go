@@ -2,20 +2,94 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 )
 
-type handlerFunc func(ctx context.Context, path string, request mcp.CallToolRequest) (*mcp.CallToolResult, error)
+type handlerFunc func(ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest) (*mcp.CallToolResult, error)
 
 type handlerCfg struct {
-	baseDir       string
+	roots         []*fsRoot
 	dockerMode    bool
 	volumeMapping *VolumeMapping
+	symlinkPolicy symlinkPolicy
+	readOnly      bool
+	enabledTools  map[string]bool
+	disabledTools map[string]bool
+	rules         pathRules
+	ignoreFiles   bool
+	trash         bool
+	maxResponse   int
+	perms         filePerms
+	locks         pathLocks
+}
+
+// pathLocks hands out one mutex per path, so the changes made by the tools to a path happen one at a time
+// and the hash check of a file cannot be interleaved with another change of the same file
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the given paths and returns the function unlocking them. Paths are locked in sorted order,
+// so two calls locking the same paths cannot deadlock. The mutex of a path is dropped once nobody holds
+// or waits for it.
+func (l *pathLocks) lock(paths ...string) func() {
+	for i, path := range paths {
+		paths[i] = filepath.Clean(path)
+	}
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*pathLock{}
+	}
+	held := make([]*pathLock, len(paths))
+	for i, path := range paths {
+		pl := l.locks[path]
+		if pl == nil {
+			pl = &pathLock{}
+			l.locks[path] = pl
+		}
+		pl.users++
+		held[i] = pl
+	}
+	l.mu.Unlock()
+
+	for _, pl := range held {
+		pl.Lock()
+	}
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+		}
+		l.mu.Lock()
+		for i, pl := range held {
+			pl.users--
+			if pl.users == 0 {
+				delete(l.locks, paths[i])
+			}
+		}
+		l.mu.Unlock()
+	}
 }
 
 type VolumeMapping struct {
@@ -23,51 +97,194 @@ type VolumeMapping struct {
 	ContainerPath string
 }
 
+// isToolEnabled reports whether a tool passes the enabled and disabled tools lists. An empty enabled
+// list means every tool is enabled.
+func (h *handlerCfg) isToolEnabled(name string) bool {
+	if len(h.enabledTools) > 0 && !h.enabledTools[name] {
+		return false
+	}
+	return !h.disabledTools[name]
+}
+
+var (
+	errPathOutsideRoots  = errors.New("path is outside of allowed base directory")
+	errPathDeniedByRules = errors.New("path is not allowed by path rules")
+)
+
+// resolveSafePath finds the root a path belongs to and checks the path against the symlink policy
+// and the path rules
+func (h *handlerCfg) resolveSafePath(path string, access pathAccess) (*fsRoot, string, error) {
+	root, rootPath, ok := findRoot(h.roots, path)
+	if !ok || !isSafePath(root.dir, rootPath, h.symlinkPolicy) {
+		return nil, "", errPathOutsideRoots
+	}
+
+	isDir := false
+	if info, err := root.Stat(rootPath); err == nil {
+		isDir = info.IsDir()
+	}
+	if !h.isPathAllowed(root, rootPath, isDir, access) {
+		log.Printf("PATH NOT ALLOWED: %s access to %s is denied by path rules", access, rootPath)
+		return nil, "", errPathDeniedByRules
+	}
+
+	return root, rootPath, nil
+}
+
+// isPathAllowed checks a path inside a root against the path rules
+func (h *handlerCfg) isPathAllowed(root *fsRoot, path string, isDir bool, access pathAccess) bool {
+	relPath, err := root.rel(path)
+	if err != nil {
+		return false
+	}
+	return h.rules.allows(relPath, isDir, access)
+}
+
+// entryFilter hides the entries of a root that cannot be read according to the path rules
+func (h *handlerCfg) entryFilter(root *fsRoot) entryFilter {
+	if len(h.rules) == 0 {
+		return nil
+	}
+	return func(path string, entry os.DirEntry) bool {
+		return h.isPathAllowed(root, path, entry.IsDir(), accessRead)
+	}
+}
+
+// writableFilter keeps the entries of a root that can be written according to the path rules
+func (h *handlerCfg) writableFilter(root *fsRoot) entryFilter {
+	if len(h.rules) == 0 {
+		return nil
+	}
+	return func(path string, entry os.DirEntry) bool {
+		return h.isPathAllowed(root, path, entry.IsDir(), accessWrite)
+	}
+}
+
+// movableFilter keeps the entries, at path or below it, that the path rules let be moved to dst in
+// dstRoot: they must be writable both where they are and where they go, and an entry that cannot be
+// read must not become readable once moved
+func (h *handlerCfg) movableFilter(root *fsRoot, path string, dstRoot *fsRoot, dst string) entryFilter {
+	if len(h.rules) == 0 {
+		return nil
+	}
+	return func(entryPath string, entry os.DirEntry) bool {
+		rel, err := filepath.Rel(path, entryPath)
+		if err != nil {
+			return false
+		}
+		newPath := filepath.Join(dst, rel)
+		return h.isPathAllowed(root, entryPath, entry.IsDir(), accessWrite) &&
+			h.isPathAllowed(dstRoot, newPath, entry.IsDir(), accessWrite) &&
+			(h.isPathAllowed(root, entryPath, entry.IsDir(), accessRead) || !h.isPathAllowed(dstRoot, newPath, entry.IsDir(), accessRead))
+	}
+}
+
+// toContainerPath translates a host path into its path inside the container volume
+func (h *handlerCfg) toContainerPath(hostPath string) (string, bool) {
+	// Ensure the path is within the allowed host directory
+	if !strings.HasPrefix(hostPath, h.volumeMapping.HostPath) {
+		log.Printf("PATH NOT ALLOWED: %s is outside of %s", hostPath, h.volumeMapping.HostPath)
+		return "", false
+	}
+
+	relPath := strings.TrimPrefix(hostPath, h.volumeMapping.HostPath)
+	containerPath := filepath.Join(h.volumeMapping.ContainerPath, filepath.Clean(relPath))
+
+	log.Printf("Path Translation: %s (host) -> %s (container)", hostPath, containerPath)
+
+	return containerPath, true
+}
+
+// resolveDestination resolves a second path argument, such as the destination of a copy, the same way
+// the path middlewares resolve the main path argument
+func (h *handlerCfg) resolveDestination(destination string) (*fsRoot, string, error) {
+	if h.dockerMode {
+		containerPath, ok := h.toContainerPath(destination)
+		if !ok {
+			return nil, "", errPathOutsideRoots
+		}
+		destination = containerPath
+	}
+	return h.resolveSafePath(destination, accessWrite)
+}
+
 func (h *handlerCfg) withSafePath(
-	handler handlerFunc,
+	handler handlerFunc, access pathAccess,
 ) server.ToolHandlerFunc {
 	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		path := request.Params.Arguments["path"].(string)
-		if !isSafePath(h.baseDir, path) {
-			log.Printf("PATH NOT ALLOWED: path is outside of allowed base directory")
-			return mcp.NewToolResultText("access denied: path is outside of allowed base directory"), nil
+		path, _ := request.GetArguments()["path"].(string)
+		root, path, err := h.resolveSafePath(path, access)
+		if err != nil {
+			log.Printf("PATH NOT ALLOWED: %v", err)
+			return mcp.NewToolResultText(fmt.Sprintf("access denied: %v", err)), nil
 		}
-		return handler(ctx, path, request)
+		return handler(ctx, root, path, request)
 	}
 }
 
 func (h *handlerCfg) withDockerPath(
-	handler handlerFunc,
+	handler handlerFunc, access pathAccess,
 ) server.ToolHandlerFunc {
 	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		hostPath := request.Params.Arguments["path"].(string)
+		hostPath, _ := request.GetArguments()["path"].(string)
 
-		// Ensure the path is within the allowed host directory
-		if !strings.HasPrefix(hostPath, h.volumeMapping.HostPath) {
-			log.Printf("PATH NOT ALLOWED: %s is outside of %s", hostPath, h.volumeMapping.HostPath)
+		containerPath, ok := h.toContainerPath(hostPath)
+		if !ok {
 			return mcp.NewToolResultText("PATH NOT ALLOWED: path is outside of allowed directory"), nil
 		}
 
-		// Translate host path to container path
-		relPath := strings.TrimPrefix(hostPath, h.volumeMapping.HostPath)
-		containerPath := filepath.Join(h.volumeMapping.ContainerPath, filepath.Clean(relPath))
+		root, containerPath, err := h.resolveSafePath(containerPath, access)
+		if err != nil {
+			log.Printf("PATH NOT ALLOWED: %s: %v", containerPath, err)
+			return mcp.NewToolResultText(fmt.Sprintf("PATH NOT ALLOWED: %v", err)), nil
+		}
 
-		log.Printf("Path Translation: %s (host) -> %s (container)", hostPath, containerPath)
+		return handler(ctx, root, containerPath, request)
+	}
+}
 
-		return handler(ctx, containerPath, request)
+// withRootsListing answers with the list of roots when no path is given
+func (h *handlerCfg) withRootsListing(fn server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if path, _ := request.GetArguments()["path"].(string); path != "" {
+			return fn(ctx, request)
+		}
+		return mcp.NewToolResultText(listRoots(h.roots).Content), nil
 	}
 }
 
 func (h *handlerCfg) handlerListEntries(
-	ctx context.Context, path string, request mcp.CallToolRequest,
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
 ) (*mcp.CallToolResult, error) {
 
-	var depth float64 = 3
-	if d, ok := request.Params.Arguments["depth"]; ok && d != nil {
-		depth = d.(float64)
+	arguments := request.GetArguments()
+	opts := defaultListOptions
+	if depth, ok := arguments["depth"].(float64); ok {
+		opts.depth = int(depth)
+	}
+	if format, _ := arguments["format"].(string); format != "" {
+		opts.format = format
+	}
+	if showHidden, ok := arguments["showHidden"].(bool); ok {
+		opts.showHidden = showHidden
+	}
+	opts.entryType, _ = arguments["type"].(string)
+	opts.include, _ = arguments["include"].(string)
+	opts.exclude, _ = arguments["exclude"].(string)
+	if sortBy, _ := arguments["sortBy"].(string); sortBy != "" {
+		opts.sortBy = sortBy
+	}
+	if maxEntries, ok := arguments["maxEntries"].(float64); ok {
+		opts.maxEntries = max(int(maxEntries), 0)
+	}
+	opts.maxBytes = h.maxResponse
+
+	filter := h.entryFilter(root)
+	if includeIgnored, _ := arguments["includeIgnored"].(bool); h.ignoreFiles && !includeIgnored {
+		filter = combineFilters(filter, ignoreFilter(root))
 	}
 
-	operationResult := listEntries(path, depth, "")
+	operationResult := listEntries(ctx, root, path, opts, filter)
 	if operationResult.Error != nil {
 		log.Printf("ERROR: %v\n", operationResult.Error)
 		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
@@ -78,13 +295,25 @@ func (h *handlerCfg) handlerListEntries(
 		return mcp.NewToolResultText(operationResult.Message), nil
 	}
 
-	return mcp.NewToolResultText(operationResult.Content), nil
+	return newToolResult(operationResult), nil
 }
 
 func (h *handlerCfg) handlerReadFile(
-	ctx context.Context, path string, request mcp.CallToolRequest,
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
 ) (*mcp.CallToolResult, error) {
-	operationResult := readFile(path)
+	var operationResult OperationResult
+	offset, hasOffset := request.GetArguments()["offset"].(float64)
+	limit, hasLimit := request.GetArguments()["limit"].(float64)
+	if hasOffset || hasLimit {
+		unit, _ := request.GetArguments()["unit"].(string)
+		if unit == "" {
+			unit = readUnitLines
+		}
+		operationResult = readFileRange(root, path, unit, int64(offset), int64(limit), int64(h.maxResponse))
+	} else {
+		operationResult = readFile(root, path, int64(h.maxResponse))
+	}
+
 	if operationResult.Error != nil {
 		log.Printf("ERROR: %v\n", operationResult.Error)
 		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
@@ -97,15 +326,25 @@ func (h *handlerCfg) handlerReadFile(
 
 	log.Printf("File sucessfully read from: %v\n", path)
 
-	return mcp.NewToolResultText(operationResult.Content), nil
+	return newToolResult(operationResult), nil
 }
 
 func (h *handlerCfg) handlerWriteToFile(
-	ctx context.Context, path string, request mcp.CallToolRequest,
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
 ) (*mcp.CallToolResult, error) {
-	content := request.Params.Arguments["content"].(string)
+	content := request.GetArguments()["content"].(string)
+
+	var mode os.FileMode
+	if m, ok := request.GetArguments()["mode"].(string); ok && m != "" {
+		parsedMode, err := parseFileMode(m)
+		if err != nil {
+			log.Printf("WARNING: %v\n", err)
+			return mcp.NewToolResultText(err.Error()), nil
+		}
+		mode = parsedMode
+	}
 
-	operationResult := writeToFile(content, path)
+	operationResult := writeToFile(root, content, path, mode, h.perms)
 	if operationResult.Error != nil {
 		log.Printf("ERROR: %v\n", operationResult.Error)
 		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
@@ -122,9 +361,11 @@ func (h *handlerCfg) handlerWriteToFile(
 }
 
 func (h *handlerCfg) handlerGetFileInfo(
-	ctx context.Context, path string, request mcp.CallToolRequest,
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
 ) (*mcp.CallToolResult, error) {
-	operationResult := getFileInfo(path)
+	aggregate, _ := request.GetArguments()["aggregate"].(bool)
+
+	operationResult := getFileInfo(ctx, root, path, aggregate, h.entryFilter(root))
 	if operationResult.Error != nil {
 		log.Printf("ERROR: %v\n", operationResult.Error)
 		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
@@ -141,11 +382,18 @@ func (h *handlerCfg) handlerGetFileInfo(
 }
 
 func (h *handlerCfg) hadlerRenamePath(
-	ctx context.Context, path string, request mcp.CallToolRequest,
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
 ) (*mcp.CallToolResult, error) {
-	newPathFinalName := request.Params.Arguments["newPathFinalName"].(string)
+	newPathFinalName := request.GetArguments()["newPathFinalName"].(string)
 
-	operationResult := renamePath(path, newPathFinalName)
+	info, err := root.Lstat(path)
+	if err == nil && !h.isPathAllowed(root, filepath.Join(filepath.Dir(path), newPathFinalName), info.IsDir(), accessWrite) {
+		log.Printf("PATH NOT ALLOWED: new name %s is denied by path rules", newPathFinalName)
+		return mcp.NewToolResultText(fmt.Sprintf("access denied: %v", errPathDeniedByRules)), nil
+	}
+
+	newPath := filepath.Join(filepath.Dir(path), newPathFinalName)
+	operationResult := renamePath(ctx, root, path, newPathFinalName, h.movableFilter(root, path, root, newPath))
 	if operationResult.Error != nil {
 		log.Printf("ERROR: %v\n", operationResult.Error)
 		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
@@ -162,16 +410,17 @@ func (h *handlerCfg) hadlerRenamePath(
 }
 
 func (h *handlerCfg) hadlerCopyFileOrDir(
-	ctx context.Context, path string, request mcp.CallToolRequest,
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
 ) (*mcp.CallToolResult, error) {
-	destination := request.Params.Arguments["destination"].(string)
+	destination := request.GetArguments()["destination"].(string)
 
-	if !h.dockerMode && !isSafePath(h.baseDir, destination) {
-		log.Printf("PATH NOT ALLOWED: path is outside of allowed base directory")
-		return mcp.NewToolResultText("access denied: path is outside of allowed base directory"), nil
+	dstRoot, destination, err := h.resolveDestination(destination)
+	if err != nil {
+		log.Printf("PATH NOT ALLOWED: %v", err)
+		return mcp.NewToolResultText(fmt.Sprintf("access denied: %v", err)), nil
 	}
 
-	operationResult := copyFileOrDir(path, destination)
+	operationResult := copyFileOrDir(ctx, root, path, dstRoot, destination, h.entryFilter(root), h.writableFilter(dstRoot), h.perms)
 	if operationResult.Error != nil {
 		log.Printf("ERROR: %v\n", operationResult.Error)
 		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
@@ -186,9 +435,509 @@ func (h *handlerCfg) hadlerCopyFileOrDir(
 	return mcp.NewToolResultText(operationResult.Content), nil
 }
 
+func (h *handlerCfg) handlerDeletePath(
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
+) (*mcp.CallToolResult, error) {
+	recursive, _ := request.GetArguments()["recursive"].(bool)
+
+	trashable := func(trashPath string) entryFilter {
+		return h.movableFilter(root, path, root, trashPath)
+	}
+	operationResult := deletePath(ctx, root, path, recursive, h.trash, h.writableFilter(root), trashable, h.perms)
+	if operationResult.Error != nil {
+		log.Printf("ERROR: %v\n", operationResult.Error)
+		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+	}
+
+	if operationResult.Message != "" {
+		log.Printf("WARNING: %v\n", operationResult.Message)
+		return mcp.NewToolResultText(operationResult.Message), nil
+	}
+
+	log.Printf("Path sucessfully deleted: %v\n", path)
+
+	return mcp.NewToolResultText(operationResult.Content), nil
+}
+
+func (h *handlerCfg) handlerMovePath(
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
+) (*mcp.CallToolResult, error) {
+	destination := request.GetArguments()["destination"].(string)
+	overwrite, _ := request.GetArguments()["overwrite"].(bool)
+
+	dstRoot, destination, err := h.resolveDestination(destination)
+	if err != nil {
+		log.Printf("PATH NOT ALLOWED: %v", err)
+		return mcp.NewToolResultText(fmt.Sprintf("access denied: %v", err)), nil
+	}
+
+	operationResult := movePath(
+		ctx, root, path, dstRoot, destination, overwrite,
+		h.movableFilter(root, path, dstRoot, destination), h.writableFilter(dstRoot), h.perms,
+	)
+	if operationResult.Error != nil {
+		log.Printf("ERROR: %v\n", operationResult.Error)
+		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+	}
+
+	if operationResult.Message != "" {
+		log.Printf("WARNING: %v\n", operationResult.Message)
+		return mcp.NewToolResultText(operationResult.Message), nil
+	}
+
+	log.Printf("Path sucessfully moved from %v to %v\n", path, destination)
+
+	return mcp.NewToolResultText(operationResult.Content), nil
+}
+
+func (h *handlerCfg) handlerCreateDirectory(
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
+) (*mcp.CallToolResult, error) {
+	parents, _ := request.GetArguments()["parents"].(bool)
+
+	mode := h.perms.dir
+	if m, ok := request.GetArguments()["mode"].(string); ok && m != "" {
+		parsedMode, err := parseFileMode(m)
+		if err != nil {
+			log.Printf("WARNING: %v\n", err)
+			return mcp.NewToolResultText(err.Error()), nil
+		}
+		mode = parsedMode
+	}
+
+	operationResult := createDirectory(root, path, parents, mode)
+	if operationResult.Error != nil {
+		log.Printf("ERROR: %v\n", operationResult.Error)
+		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+	}
+
+	if operationResult.Message != "" {
+		log.Printf("WARNING: %v\n", operationResult.Message)
+		return mcp.NewToolResultText(operationResult.Message), nil
+	}
+
+	log.Printf("Directory sucessfully created at: %v\n", path)
+
+	return mcp.NewToolResultText(operationResult.Content), nil
+}
+
+// newToolResult returns the content of an operation, followed by its metadata as a JSON text block
+func newToolResult(operationResult OperationResult) *mcp.CallToolResult {
+	result := mcp.NewToolResultText(operationResult.Content)
+	if operationResult.Structured != nil {
+		result = mcp.NewToolResultStructured(operationResult.Structured, operationResult.Content)
+	}
+	if len(operationResult.Metadata) == 0 {
+		return result
+	}
+
+	metadata, err := json.Marshal(operationResult.Metadata)
+	if err != nil {
+		log.Printf("ERROR: could not encode metadata: %v\n", err)
+		return result
+	}
+	result.Content = append(result.Content, mcp.NewTextContent(string(metadata)))
+	return result
+}
+
+func (h *handlerCfg) handlerAppendToFile(
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
+) (*mcp.CallToolResult, error) {
+	content := request.GetArguments()["content"].(string)
+	ensureNewline, _ := request.GetArguments()["ensureNewline"].(bool)
+
+	operationResult := appendToFile(root, content, path, ensureNewline, h.perms)
+	if operationResult.Error != nil {
+		log.Printf("ERROR: %v\n", operationResult.Error)
+		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+	}
+
+	if operationResult.Message != "" {
+		log.Printf("WARNING: %v\n", operationResult.Message)
+		return mcp.NewToolResultText(operationResult.Message), nil
+	}
+
+	log.Printf("Content sucessfully appended to: %v\n", path)
+
+	return mcp.NewToolResultText(operationResult.Content), nil
+}
+
+func (h *handlerCfg) handlerInsertLines(
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
+) (*mcp.CallToolResult, error) {
+	line, _ := request.GetArguments()["line"].(float64)
+	content := request.GetArguments()["content"].(string)
+
+	operationResult := insertLines(root, path, int(line), content)
+	if operationResult.Error != nil {
+		log.Printf("ERROR: %v\n", operationResult.Error)
+		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+	}
+
+	if operationResult.Message != "" {
+		log.Printf("WARNING: %v\n", operationResult.Message)
+		return mcp.NewToolResultText(operationResult.Message), nil
+	}
+
+	log.Printf("Lines sucessfully inserted in: %v\n", path)
+
+	return mcp.NewToolResultText(operationResult.Content), nil
+}
+
+func (h *handlerCfg) handlerDeleteLines(
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
+) (*mcp.CallToolResult, error) {
+	startLine, _ := request.GetArguments()["startLine"].(float64)
+	endLine, ok := request.GetArguments()["endLine"].(float64)
+	if !ok {
+		endLine = startLine
+	}
+
+	operationResult := deleteLines(root, path, int(startLine), int(endLine))
+	if operationResult.Error != nil {
+		log.Printf("ERROR: %v\n", operationResult.Error)
+		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+	}
+
+	if operationResult.Message != "" {
+		log.Printf("WARNING: %v\n", operationResult.Message)
+		return mcp.NewToolResultText(operationResult.Message), nil
+	}
+
+	log.Printf("Lines sucessfully deleted from: %v\n", path)
+
+	return mcp.NewToolResultText(operationResult.Content), nil
+}
+
+func (h *handlerCfg) handlerSearchFiles(
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
+) (*mcp.CallToolResult, error) {
+	arguments := request.GetArguments()
+
+	search := fileSearch{maxResults: 100}
+	search.pattern, _ = arguments["pattern"].(string)
+	search.name, _ = arguments["name"].(string)
+	search.entryType, _ = arguments["type"].(string)
+	if regex, _ := arguments["regex"].(string); regex != "" {
+		compiled, err := regexp.Compile(regex)
+		if err != nil {
+			message := fmt.Sprintf("invalid regex: %v", err)
+			log.Printf("WARNING: %v\n", message)
+			return mcp.NewToolResultText(message), nil
+		}
+		search.regex = compiled
+	}
+	if minSize, ok := arguments["minSize"].(float64); ok {
+		search.minSize = int64(minSize)
+	}
+	if maxSize, ok := arguments["maxSize"].(float64); ok {
+		search.maxSize = int64(maxSize)
+	}
+	if maxResults, ok := arguments["maxResults"].(float64); ok {
+		search.maxResults = int(maxResults)
+	}
+	for name, value := range map[string]*time.Time{
+		"modifiedAfter":  &search.modifiedAfter,
+		"modifiedBefore": &search.modifiedBefore,
+	} {
+		if t, _ := arguments[name].(string); t != "" {
+			parsed, err := time.Parse(time.RFC3339, t)
+			if err != nil {
+				message := fmt.Sprintf("invalid %s %q, use the RFC 3339 format such as 2024-01-31T15:04:05Z", name, t)
+				log.Printf("WARNING: %v\n", message)
+				return mcp.NewToolResultText(message), nil
+			}
+			*value = parsed
+		}
+	}
+
+	filter := h.entryFilter(root)
+	if includeIgnored, _ := arguments["includeIgnored"].(bool); h.ignoreFiles && !includeIgnored {
+		filter = combineFilters(filter, ignoreFilter(root))
+	}
+
+	operationResult := searchFiles(ctx, root, path, search, filter)
+	if operationResult.Error != nil {
+		log.Printf("ERROR: %v\n", operationResult.Error)
+		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+	}
+
+	if operationResult.Message != "" {
+		log.Printf("WARNING: %v\n", operationResult.Message)
+		return mcp.NewToolResultText(operationResult.Message), nil
+	}
+
+	log.Printf("Search sucessfully done under: %v\n", path)
+
+	return newToolResult(operationResult), nil
+}
+
+func (h *handlerCfg) handlerGrepContent(
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
+) (*mcp.CallToolResult, error) {
+	arguments := request.GetArguments()
+
+	pattern := arguments["pattern"].(string)
+	if ignoreCase, _ := arguments["ignoreCase"].(bool); ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		message := fmt.Sprintf("invalid pattern: %v", err)
+		log.Printf("WARNING: %v\n", message)
+		return mcp.NewToolResultText(message), nil
+	}
+
+	search := contentSearch{regex: regex, maxResults: 100}
+	search.include, _ = arguments["include"].(string)
+	if contextLines, ok := arguments["contextLines"].(float64); ok {
+		search.contextLines = max(int(contextLines), 0)
+	}
+	if maxResults, ok := arguments["maxResults"].(float64); ok {
+		search.maxResults = int(maxResults)
+	}
+
+	filter := h.entryFilter(root)
+	if includeIgnored, _ := arguments["includeIgnored"].(bool); h.ignoreFiles && !includeIgnored {
+		filter = combineFilters(filter, ignoreFilter(root))
+	}
+
+	operationResult := grepContent(ctx, root, path, search, filter)
+	if operationResult.Error != nil {
+		log.Printf("ERROR: %v\n", operationResult.Error)
+		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+	}
+
+	if operationResult.Message != "" {
+		log.Printf("WARNING: %v\n", operationResult.Message)
+		return mcp.NewToolResultText(operationResult.Message), nil
+	}
+
+	log.Printf("Content sucessfully searched under: %v\n", path)
+
+	return newToolResult(operationResult), nil
+}
+
+func (h *handlerCfg) handlerEditFile(
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
+) (*mcp.CallToolResult, error) {
+	rawEdits, _ := request.GetArguments()["edits"].([]any)
+
+	edits := make([]textEdit, 0, len(rawEdits))
+	for i, rawEdit := range rawEdits {
+		fields, _ := rawEdit.(map[string]any)
+		oldText, oldOk := fields["oldText"].(string)
+		newText, newOk := fields["newText"].(string)
+		if !oldOk || !newOk {
+			message := fmt.Sprintf("edit %d: oldText and newText are required", i+1)
+			log.Printf("WARNING: %v\n", message)
+			return mcp.NewToolResultText(message), nil
+		}
+		replaceAll, _ := fields["replaceAll"].(bool)
+		edits = append(edits, textEdit{oldText: oldText, newText: newText, replaceAll: replaceAll})
+	}
+
+	operationResult := editFile(root, path, edits)
+	if operationResult.Error != nil {
+		log.Printf("ERROR: %v\n", operationResult.Error)
+		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+	}
+
+	if operationResult.Message != "" {
+		log.Printf("WARNING: %v\n", operationResult.Message)
+		return mcp.NewToolResultText(operationResult.Message), nil
+	}
+
+	log.Printf("File sucessfully edited at: %v\n", path)
+
+	return mcp.NewToolResultText(operationResult.Content), nil
+}
+
+func (h *handlerCfg) handlerApplyPatch(
+	ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest,
+) (*mcp.CallToolResult, error) {
+	patchText := request.GetArguments()["patch"].(string)
+
+	patches, err := parsePatch(patchText)
+	if err != nil {
+		log.Printf("WARNING: %v\n", err)
+		return mcp.NewToolResultText(fmt.Sprintf("invalid patch: %v", err)), nil
+	}
+
+	// Every file the patch touches must be a safe path the rules allow writing to, and a renamed file
+	// must stay in its root
+	resolve := func(name string) (*fsRoot, string, error) {
+		if name == "" {
+			return nil, "", nil
+		}
+		if filepath.IsAbs(name) {
+			return h.resolveDestination(name)
+		}
+		return h.resolveSafePath(filepath.Join(path, filepath.FromSlash(name)), accessWrite)
+	}
+	targets := make([]patchTarget, 0, len(patches))
+	for _, patch := range patches {
+		oldRoot, oldPath, err := resolve(patch.oldName)
+		if err != nil {
+			log.Printf("PATH NOT ALLOWED: %v", err)
+			return mcp.NewToolResultText(fmt.Sprintf("access denied: %s: %v", patch.oldName, err)), nil
+		}
+		newRoot, newPath, err := resolve(patch.newName)
+		if err != nil {
+			log.Printf("PATH NOT ALLOWED: %v", err)
+			return mcp.NewToolResultText(fmt.Sprintf("access denied: %s: %v", patch.newName, err)), nil
+		}
+		if oldRoot != nil && newRoot != nil && oldRoot != newRoot {
+			message := fmt.Sprintf("%s cannot be renamed to %s, which is in another root", patch.oldName, patch.newName)
+			log.Printf("WARNING: %v\n", message)
+			return mcp.NewToolResultText(message), nil
+		}
+		if oldRoot == nil {
+			oldRoot = newRoot
+		}
+		targets = append(targets, patchTarget{patch: patch, root: oldRoot, oldPath: oldPath, newPath: newPath})
+	}
+
+	paths := []string{}
+	for _, target := range targets {
+		for _, targetPath := range []string{target.oldPath, target.newPath} {
+			if targetPath != "" {
+				paths = append(paths, targetPath)
+			}
+		}
+	}
+	unlock := h.locks.lock(paths...)
+	defer unlock()
+
+	operationResult := applyPatch(targets, h.perms)
+	if operationResult.Error != nil {
+		log.Printf("ERROR: %v\n", operationResult.Error)
+		return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+	}
+
+	if operationResult.Message != "" {
+		log.Printf("WARNING: %v\n", operationResult.Message)
+		return mcp.NewToolResultText(operationResult.Message), nil
+	}
+
+	log.Printf("Patch sucessfully applied in: %v\n", path)
+
+	return mcp.NewToolResultText(operationResult.Content), nil
+}
+
+// withPathLock runs a handler that modifies files with its path locked, along with the destination or
+// new name of the tools that have one. Paths below a directory are not locked when the directory is, so a
+// recursive change of a directory can still interleave with changes below it.
+func (h *handlerCfg) withPathLock(handler handlerFunc) handlerFunc {
+	return func(ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		paths := []string{path}
+		if destination, _ := request.GetArguments()["destination"].(string); destination != "" {
+			if h.dockerMode && strings.HasPrefix(destination, h.volumeMapping.HostPath) {
+				destination, _ = h.toContainerPath(destination)
+			}
+			if _, destination, ok := findRoot(h.roots, destination); ok {
+				paths = append(paths, destination)
+			}
+		}
+		if newName, _ := request.GetArguments()["newPathFinalName"].(string); newName != "" {
+			paths = append(paths, filepath.Join(filepath.Dir(path), newName))
+		}
+
+		unlock := h.locks.lock(paths...)
+		defer unlock()
+		return handler(ctx, root, path, request)
+	}
+}
+
+// withExpectedHash refuses to run a handler when the request has an expectedHash and the file at path no
+// longer has this content hash, so a client does not overwrite changes made since it read the file. It
+// runs under the lock withPathLock takes for every tool modifying files, so no other tool can change the
+// file between the check and the change.
+func (h *handlerCfg) withExpectedHash(handler handlerFunc) handlerFunc {
+	return func(ctx context.Context, root *fsRoot, path string, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		expectedHash, _ := request.GetArguments()["expectedHash"].(string)
+		if expectedHash == "" {
+			return handler(ctx, root, path, request)
+		}
+
+		operationResult := checkFileHash(root, path, expectedHash)
+		if operationResult.Error != nil {
+			log.Printf("ERROR: %v\n", operationResult.Error)
+			return mcp.NewToolResultErrorFromErr("", operationResult.Error), operationResult.Error
+		}
+
+		if operationResult.Message != "" {
+			log.Printf("WARNING: %v\n", operationResult.Message)
+			return mcp.NewToolResultText(operationResult.Message), nil
+		}
+
+		return handler(ctx, root, path, request)
+	}
+}
+
+// withResponseLimit truncates the text returned by a tool when it goes over the maximum response size.
+// The text is cut at the end of a line when possible, and the metadata block of the result, added when
+// missing, tells the agent the response was truncated and how to fetch the rest.
+func (h *handlerCfg) withResponseLimit(name string, fn server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := fn(ctx, request)
+		if result == nil || h.maxResponse <= 0 || len(result.Content) == 0 {
+			return result, err
+		}
+
+		// The text of a structured result is its encoding, which cannot be cut without breaking it. Tools
+		// returning structured content fit it to the limit themselves.
+		text, ok := result.Content[0].(mcp.TextContent)
+		if !ok || len(text.Text) <= h.maxResponse || result.StructuredContent != nil {
+			return result, err
+		}
+
+		totalSize := len(text.Text)
+		truncated := truncateText(text.Text, h.maxResponse)
+		log.Printf("WARNING: '%s' response truncated from %d to %d bytes\n", name, totalSize, len(truncated))
+		text.Text = truncated
+		result.Content[0] = text
+
+		metadata := map[string]any{}
+		if len(result.Content) > 1 {
+			if block, ok := result.Content[1].(mcp.TextContent); ok && json.Unmarshal([]byte(block.Text), &metadata) == nil {
+				result.Content = slices.Delete(result.Content, 1, 2)
+			}
+		}
+		for key, value := range truncationMetadata(name, truncated, totalSize) {
+			metadata[key] = value
+		}
+		encoded, _ := json.Marshal(metadata)
+		result.Content = slices.Insert(result.Content, 1, mcp.Content(mcp.NewTextContent(string(encoded))))
+		return result, err
+	}
+}
+
+// truncationMetadata describes a truncated response and tells the agent how to fetch the rest.
+// readFromFile stops reading at the limit itself and reports where to continue in its range metadata.
+func truncationMetadata(name string, truncated string, totalSize int) map[string]any {
+	metadata := map[string]any{
+		"truncated":     true,
+		"responseBytes": len(truncated),
+		"omittedBytes":  totalSize - len(truncated),
+	}
+
+	switch name {
+	case "listEntries":
+		metadata["hint"] = "call listEntries with a lower depth or maxEntries, a narrower include, or on a subdirectory, to see the rest"
+	case "grepContent":
+		metadata["hint"] = "call grepContent with a lower maxResults or contextLines, or a narrower include or path, to see the rest"
+	case "searchFiles":
+		metadata["hint"] = "call searchFiles with a lower maxResults, or a narrower pattern or path, to see the rest"
+	default:
+		metadata["hint"] = "narrow down the request to get the rest"
+	}
+	return metadata
+}
+
 func handlersMiddleware(name string, fn server.ToolHandlerFunc) server.ToolHandlerFunc {
 	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		log.Printf("'%s' called with params: %v", name, request.Params.Arguments)
+		log.Printf("'%s' called with params: %v", name, request.GetArguments())
 		return fn(ctx, request)
 	}
 }
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// newTestHandlerCfg returns a handler configuration serving the given directories, with the defaults
+// of the command line flags
+func newTestHandlerCfg(t *testing.T, dirs ...string) *handlerCfg {
+	t.Helper()
+
+	h := &handlerCfg{symlinkPolicy: symlinkFollowWithinRoot, perms: defaultFilePerms}
+	for _, dir := range dirs {
+		h.roots = append(h.roots, newTestRoot(t, dir))
+	}
+	return h
+}
+
+// callServer sends a JSON-RPC request to the server and returns its result
+func callServer(t *testing.T, mcpServer *server.MCPServer, method string, params any) json.RawMessage {
+	t.Helper()
+
+	request, err := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	if err != nil {
+		t.Fatalf("Failed to encode the request: %v", err)
+	}
+	response, err := json.Marshal(mcpServer.HandleMessage(context.Background(), request))
+	if err != nil {
+		t.Fatalf("Failed to encode the response: %v", err)
+	}
+
+	var decoded struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(response, &decoded); err != nil {
+		t.Fatalf("Failed to decode the response: %v", err)
+	}
+	if decoded.Error != nil {
+		t.Fatalf("%s failed: %s", method, decoded.Error.Message)
+	}
+	return decoded.Result
+}
+
+// callTool calls a tool through the same middlewares as the server does
+func callTool(t *testing.T, h *handlerCfg, name string, arguments map[string]any) *mcp.CallToolResult {
+	t.Helper()
+
+	mcpServer, err := fileSystemMCP(h)
+	if err != nil {
+		t.Fatalf("Failed to create the server: %v", err)
+	}
+	var result mcp.CallToolResult
+	if err := json.Unmarshal(callServer(t, mcpServer, "tools/call", map[string]any{"name": name, "arguments": arguments}), &result); err != nil {
+		t.Fatalf("Failed to decode the tool result: %v", err)
+	}
+	return &result
+}
+
+// resultText returns the text blocks of a tool result
+func resultText(result *mcp.CallToolResult) []string {
+	texts := []string{}
+	for _, content := range result.Content {
+		if text, ok := content.(mcp.TextContent); ok {
+			texts = append(texts, text.Text)
+		}
+	}
+	return texts
+}
+
+func TestMoveRulesOnDescendants(t *testing.T) {
+	tmpDir := t.TempDir()
+	h := newTestHandlerCfg(t, tmpDir)
+	rules, err := parseRules(strings.NewReader("deny rw config/secret.yml\ndeny read docs/private.md\ndeny write archive/\ndeny write keep/locked.txt\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	h.rules = rules
+
+	for _, name := range []string{"config/secret.yml", "config/app.yml", "docs/private.md", "docs/guide.md", "logs/app.log", "old/notes.txt", "keep/locked.txt", "fresh/new.txt"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tmpDir, name)), 0755)
+		os.WriteFile(filepath.Join(tmpDir, name), []byte("test"), 0644)
+	}
+	os.MkdirAll(filepath.Join(tmpDir, "archive"), 0755)
+	path := func(name string) string {
+		return filepath.Join(tmpDir, filepath.FromSlash(name))
+	}
+
+	tests := []struct {
+		name       string
+		tool       string
+		arguments  map[string]any
+		expectText string
+		expectKept string
+	}{
+		{
+			name:       "rename a directory holding a denied file",
+			tool:       "renamePath",
+			arguments:  map[string]any{"path": path("config"), "newPathFinalName": "cfg"},
+			expectText: "cannot rename " + path("config") + ", " + path("config/secret.yml") + " is protected by path rules",
+			expectKept: "config/secret.yml",
+		},
+		{
+			name:       "move a directory holding a denied file",
+			tool:       "movePath",
+			arguments:  map[string]any{"path": path("config"), "destination": path("moved/config")},
+			expectText: "cannot move " + path("config") + ", " + path("config/secret.yml") + " is protected by path rules",
+			expectKept: "config/secret.yml",
+		},
+		{
+			name:       "move would make an unreadable file readable",
+			tool:       "movePath",
+			arguments:  map[string]any{"path": path("docs"), "destination": path("public")},
+			expectText: "cannot move " + path("docs") + ", " + path("docs/private.md") + " is protected by path rules",
+			expectKept: "docs/private.md",
+		},
+		{
+			name:       "move into a directory that cannot be written",
+			tool:       "movePath",
+			arguments:  map[string]any{"path": path("old"), "destination": path("archive/old")},
+			expectText: "access denied: " + errPathDeniedByRules.Error(),
+			expectKept: "old/notes.txt",
+		},
+		{
+			name:       "overwrite a directory holding a denied file",
+			tool:       "movePath",
+			arguments:  map[string]any{"path": path("fresh"), "destination": path("keep"), "overwrite": true},
+			expectText: "cannot overwrite " + path("keep") + ", " + path("keep/locked.txt") + " below it is protected by path rules",
+			expectKept: "keep/locked.txt",
+		},
+		{
+			name:       "rename a directory without denied entries",
+			tool:       "renamePath",
+			arguments:  map[string]any{"path": path("logs"), "newPathFinalName": "logs-old"},
+			expectText: path("logs-old"),
+			expectKept: "logs-old/app.log",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := callTool(t, h, tt.tool, tt.arguments)
+			if text := resultText(result); len(text) == 0 || text[0] != tt.expectText {
+				t.Errorf("Got %q, expected: %q", text, tt.expectText)
+			}
+			if _, err := os.Stat(path(tt.expectKept)); err != nil {
+				t.Errorf("Expected %s to exist, got: %v", tt.expectKept, err)
+			}
+		})
+	}
+}
+
+func TestExpectedHashConcurrentWrites(t *testing.T) {
+	tmpDir := t.TempDir()
+	h := newTestHandlerCfg(t, tmpDir)
+	root := h.roots[0]
+	path := filepath.Join(tmpDir, "shared.txt")
+	if err := os.WriteFile(path, []byte("original"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	hash, err := fileHash(root, path)
+	if err != nil {
+		t.Fatalf("Failed to hash test file: %v", err)
+	}
+
+	// Handlers wrapped the way createMCPServer wraps the tools modifying files
+	write := h.withPathLock(h.withExpectedHash(h.handlerWriteToFile))
+	appendTo := h.withPathLock(h.handlerAppendToFile)
+	call := func(handler handlerFunc, name string, arguments map[string]any) error {
+		var request mcp.CallToolRequest
+		request.Params.Name = name
+		request.Params.Arguments = arguments
+		_, err := handler(context.Background(), root, path, request)
+		return err
+	}
+
+	const writers, appenders = 8, 8
+	errs := make([]error, writers+appenders)
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = call(write, "writeToFile", map[string]any{"path": path, "content": fmt.Sprintf("writer %d", i), "expectedHash": hash})
+		}()
+	}
+	for i := range appenders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[writers+i] = call(appendTo, "appendToFile", map[string]any{"path": path, "content": "+"})
+		}()
+	}
+	wg.Wait()
+
+	written := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && i < writers:
+			if written >= 0 {
+				t.Errorf("Writers %d and %d both wrote with the same expectedHash", written, i)
+			}
+			written = i
+		case err != nil && !errors.Is(err, errHashConflict):
+			t.Errorf("Call %d got an unexpected error: %v", i, err)
+		}
+	}
+
+	// A write only passes its check before any append, so every append must come after it
+	expected := "original" + strings.Repeat("+", appenders)
+	if written >= 0 {
+		expected = fmt.Sprintf("writer %d", written) + strings.Repeat("+", appenders)
+	}
+	if content, _ := os.ReadFile(path); string(content) != expected {
+		t.Errorf("Got %q, expected: %q", content, expected)
+	}
+}
+
+func TestListEntriesJSONResponseLimit(t *testing.T) {
+	tmpDir := t.TempDir()
+	h := newTestHandlerCfg(t, tmpDir)
+	h.maxResponse = 1500
+	for _, dir := range []string{"alpha", "beta", "gamma"} {
+		os.MkdirAll(filepath.Join(tmpDir, dir), 0755)
+		for i := range 20 {
+			os.WriteFile(filepath.Join(tmpDir, dir, fmt.Sprintf("file_%02d.txt", i)), []byte("test"), 0644)
+		}
+	}
+
+	result := callTool(t, h, "listEntries", map[string]any{"path": tmpDir, "format": "json"})
+	text := resultText(result)
+	if len(text) != 1 {
+		t.Fatalf("Expected a single text block, got %q", text)
+	}
+	if len(text[0]) > h.maxResponse {
+		t.Errorf("Expected at most %d bytes, got %d", h.maxResponse, len(text[0]))
+	}
+
+	var tree struct {
+		Truncated bool         `json:"truncated"`
+		More      int          `json:"more"`
+		Entries   []*treeEntry `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(text[0]), &tree); err != nil {
+		t.Fatalf("Expected valid JSON, got %v:\n%s", err, text[0])
+	}
+	if !tree.Truncated {
+		t.Errorf("Expected the tree to be marked as truncated")
+	}
+	if len(tree.Entries) != 3 || tree.More != 0 {
+		t.Errorf("Expected the 3 top level directories to be kept, got %d and %d more", len(tree.Entries), tree.More)
+	}
+	listed := 0
+	for _, dir := range tree.Entries {
+		if len(dir.Entries)+dir.More != 20 {
+			t.Errorf("Expected %s to count its 20 entries, got %d and %d more", dir.Name, len(dir.Entries), dir.More)
+		}
+		listed += len(dir.Entries)
+	}
+	if listed == 0 || listed == 60 {
+		t.Errorf("Expected some of the files to be listed, got %d", listed)
+	}
+
+	var fromText, fromStructured any
+	json.Unmarshal([]byte(text[0]), &fromText)
+	structured, _ := json.Marshal(result.StructuredContent)
+	json.Unmarshal(structured, &fromStructured)
+	if !reflect.DeepEqual(fromText, fromStructured) {
+		t.Errorf("Expected the structured content to match the text, got:\n%s\n%s", text[0], structured)
+	}
+}
+
+func TestResponseLimit(t *testing.T) {
+	tmpDir := t.TempDir()
+	h := newTestHandlerCfg(t, tmpDir)
+	h.maxResponse = 50
+
+	// 20 lines of 8 bytes
+	var content strings.Builder
+	for i := range 20 {
+		fmt.Fprintf(&content, "line %02d\n", i+1)
+	}
+	path := filepath.Join(tmpDir, "lines.txt")
+	os.WriteFile(path, []byte(content.String()), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "short.txt"), []byte("short\n"), 0644)
+	lines := func(from, to int) string {
+		return content.String()[(from-1)*8 : to*8]
+	}
+
+	tests := []struct {
+		name           string
+		arguments      map[string]any
+		expectText     string
+		expectMetadata map[string]any
+	}{
+		{
+			name:       "whole file cut at the end of a line",
+			arguments:  map[string]any{"path": path},
+			expectText: lines(1, 6),
+			expectMetadata: map[string]any{
+				"truncated": true, "responseBytes": 48.0, "omittedBytes": 112.0,
+				"returned": 6.0, "hasMore": true, "nextOffset": 6.0,
+				"hint": "call readFromFile again with unit=lines and offset=6 to read the rest",
+			},
+		},
+		{
+			name:       "lines range merged into the range metadata",
+			arguments:  map[string]any{"path": path, "offset": 5.0},
+			expectText: lines(6, 11),
+			expectMetadata: map[string]any{
+				"truncated": true, "responseBytes": 48.0, "omittedBytes": 72.0,
+				"unit": "lines", "offset": 5.0, "totalLines": 20.0, "totalBytes": 160.0,
+				"returned": 6.0, "hasMore": true, "nextOffset": 11.0,
+				"hint": "call readFromFile again with unit=lines and offset=11 to read the rest",
+			},
+		},
+		{
+			name:       "bytes range cut at the limit",
+			arguments:  map[string]any{"path": path, "unit": "bytes", "offset": 10.0},
+			expectText: content.String()[10:60],
+			expectMetadata: map[string]any{
+				"truncated": true, "responseBytes": 50.0, "omittedBytes": 100.0,
+				"unit": "bytes", "offset": 10.0, "totalBytes": 160.0,
+				"returned": 50.0, "hasMore": true, "nextOffset": 60.0,
+				"hint": "call readFromFile again with unit=bytes and offset=60 to read the rest",
+			},
+		},
+		{
+			name:           "response under the limit",
+			arguments:      map[string]any{"path": filepath.Join(tmpDir, "short.txt")},
+			expectText:     "short\n",
+			expectMetadata: map[string]any{"hash": contentHash([]byte("short\n"))},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := resultText(callTool(t, h, "readFromFile", tt.arguments))
+			if len(text) != 2 {
+				t.Fatalf("Expected the text and a metadata block, got %q", text)
+			}
+			if text[0] != tt.expectText {
+				t.Errorf("Got text %q, expected: %q", text[0], tt.expectText)
+			}
+
+			metadata := map[string]any{}
+			if err := json.Unmarshal([]byte(text[1]), &metadata); err != nil {
+				t.Fatalf("Invalid metadata block %q: %v", text[1], err)
+			}
+			if _, ok := metadata["hash"]; !ok {
+				t.Errorf("Expected the hash of the file to be kept in %v", metadata)
+			}
+			for key, expected := range tt.expectMetadata {
+				if !reflect.DeepEqual(metadata[key], expected) {
+					t.Errorf("Got %s %v, expected: %v", key, metadata[key], expected)
+				}
+			}
+			if _, truncated := tt.expectMetadata["truncated"]; !truncated && metadata["truncated"] != nil {
+				t.Errorf("Expected no truncation, got %v", metadata)
+			}
+		})
+	}
+}
+
+func TestTrashRules(t *testing.T) {
+	tmpDir := t.TempDir()
+	h := newTestHandlerCfg(t, tmpDir)
+	h.trash = true
+	rules, err := parseRules(strings.NewReader("deny read /secrets\ndeny read *.pem\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	h.rules = rules
+
+	for _, name := range []string{"secrets/key", "certs/server.pem", "logs/app.log"} {
+		os.MkdirAll(filepath.Join(tmpDir, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(tmpDir, name), []byte("test"), 0644)
+	}
+	path := func(name string) string {
+		return filepath.Join(tmpDir, filepath.FromSlash(name))
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		expectText    string
+		expectKept    bool
+		expectTrashed string
+	}{
+		{
+			name:       "trash would make a read-denied directory readable",
+			path:       "secrets",
+			expectText: "cannot move " + path("secrets") + " to the trash, " + path("secrets") + " is protected by path rules",
+			expectKept: true,
+		},
+		{
+			name:          "entries stay read-denied in the trash",
+			path:          "certs",
+			expectText:    "path moved to trash at ",
+			expectTrashed: "certs/server.pem",
+		},
+		{
+			name:          "directory without denied entries",
+			path:          "logs",
+			expectText:    "path moved to trash at ",
+			expectTrashed: "logs/app.log",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := callTool(t, h, "deletePath", map[string]any{"path": path(tt.path), "recursive": true})
+			if text := resultText(result); len(text) == 0 || !strings.HasPrefix(text[0], tt.expectText) {
+				t.Fatalf("Got %q, expected: %q", text, tt.expectText)
+			}
+			if _, err := os.Stat(path(tt.path)); (err == nil) != tt.expectKept {
+				t.Errorf("Expected %s to be kept: %v, got: %v", tt.path, tt.expectKept, err)
+			}
+			if tt.expectTrashed != "" {
+				trashed, _ := filepath.Glob(filepath.Join(tmpDir, trashDirName, "*", filepath.FromSlash(tt.expectTrashed)))
+				if len(trashed) != 1 {
+					t.Errorf("Expected %s in the trash, got %v", tt.expectTrashed, trashed)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyRulesOnDestination(t *testing.T) {
+	tmpDir := t.TempDir()
+	h := newTestHandlerCfg(t, tmpDir)
+	rules, err := parseRules(strings.NewReader("deny write /config/*.yaml\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	h.rules = rules
+
+	os.MkdirAll(filepath.Join(tmpDir, "x"), 0755)
+	os.MkdirAll(filepath.Join(tmpDir, "config"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "x", "app.yaml"), []byte("copy"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "x", "notes.txt"), []byte("copy"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "config", "app.yaml"), []byte("original"), 0644)
+	path := func(name string) string {
+		return filepath.Join(tmpDir, filepath.FromSlash(name))
+	}
+
+	tests := []struct {
+		name          string
+		arguments     map[string]any
+		expectText    string
+		expectContent map[string]string
+	}{
+		{
+			name:          "copy a directory over a write-denied entry",
+			arguments:     map[string]any{"path": path("x"), "destination": path("config")},
+			expectText:    "cannot copy " + path("x") + " to " + path("config") + ", " + path("config/app.yaml") + " is protected by path rules",
+			expectContent: map[string]string{"config/app.yaml": "original"},
+		},
+		{
+			name:          "copy a file over a write-denied file",
+			arguments:     map[string]any{"path": path("x/app.yaml"), "destination": path("config/app.yaml")},
+			expectText:    "access denied: " + errPathDeniedByRules.Error(),
+			expectContent: map[string]string{"config/app.yaml": "original"},
+		},
+		{
+			name:          "copy a directory where every entry can be written",
+			arguments:     map[string]any{"path": path("x"), "destination": path("backup")},
+			expectText:    "",
+			expectContent: map[string]string{"backup/app.yaml": "copy", "backup/notes.txt": "copy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := callTool(t, h, "copyFileOrDir", tt.arguments)
+			if text := resultText(result); len(text) == 0 || (tt.expectText != "" && text[0] != tt.expectText) {
+				t.Errorf("Got %q, expected: %q", text, tt.expectText)
+			}
+			for name, expected := range tt.expectContent {
+				if content, err := os.ReadFile(path(name)); err != nil || string(content) != expected {
+					t.Errorf("Expected %s to hold %q, got %q (%v)", name, expected, content, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAbsoluteSymlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+	outsideDir := t.TempDir()
+	h := newTestHandlerCfg(t, tmpDir)
+	os.WriteFile(filepath.Join(tmpDir, "real.txt"), []byte("real"), 0644)
+	os.WriteFile(filepath.Join(outsideDir, "secret.txt"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(tmpDir, "real.txt"), filepath.Join(tmpDir, "abs"))
+	os.Symlink(filepath.Join(outsideDir, "secret.txt"), filepath.Join(tmpDir, "abs-outside"))
+
+	tests := []struct {
+		name       string
+		path       string
+		expectText string
+	}{
+		{
+			name:       "link pointing inside the root",
+			path:       filepath.Join(tmpDir, "abs"),
+			expectText: "real",
+		},
+		{
+			name:       "link pointing outside the root",
+			path:       filepath.Join(tmpDir, "abs-outside"),
+			expectText: "access denied: ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := resultText(callTool(t, h, "readFromFile", map[string]any{"path": tt.path}))
+			if len(text) == 0 || !strings.HasPrefix(text[0], tt.expectText) {
+				t.Errorf("Got %q, expected: %q", text, tt.expectText)
+			}
+		})
+	}
+}
+
+func TestModifyingToolsTakePathLock(t *testing.T) {
+	tests := []struct {
+		name      string
+		tool      string
+		arguments func(dir string) map[string]any
+		locked    string
+	}{
+		{
+			name: "editFile",
+			tool: "editFile",
+			arguments: func(dir string) map[string]any {
+				return map[string]any{"path": filepath.Join(dir, "a.txt"), "edits": []any{map[string]any{"oldText": "one", "newText": "ONE"}}}
+			},
+			locked: "a.txt",
+		},
+		{
+			name: "appendToFile",
+			tool: "appendToFile",
+			arguments: func(dir string) map[string]any {
+				return map[string]any{"path": filepath.Join(dir, "a.txt"), "content": "three\n"}
+			},
+			locked: "a.txt",
+		},
+		{
+			name: "applyPatch locks the patched files",
+			tool: "applyPatch",
+			arguments: func(dir string) map[string]any {
+				return map[string]any{"path": dir, "patch": "--- a/a.txt\n+++ b/a.txt\n@@ -1,2 +1,2 @@\n one\n-two\n+TWO\n"}
+			},
+			locked: "a.txt",
+		},
+		{
+			name: "movePath locks its source",
+			tool: "movePath",
+			arguments: func(dir string) map[string]any {
+				return map[string]any{"path": filepath.Join(dir, "a.txt"), "destination": filepath.Join(dir, "b.txt")}
+			},
+			locked: "a.txt",
+		},
+		{
+			name: "movePath locks its destination",
+			tool: "movePath",
+			arguments: func(dir string) map[string]any {
+				return map[string]any{"path": filepath.Join(dir, "a.txt"), "destination": filepath.Join(dir, "b.txt")}
+			},
+			locked: "b.txt",
+		},
+		{
+			name: "renamePath locks the new name",
+			tool: "renamePath",
+			arguments: func(dir string) map[string]any {
+				return map[string]any{"path": filepath.Join(dir, "a.txt"), "newPathFinalName": "b.txt"}
+			},
+			locked: "b.txt",
+		},
+		{
+			name: "copyFileOrDir locks its destination",
+			tool: "copyFileOrDir",
+			arguments: func(dir string) map[string]any {
+				return map[string]any{"path": filepath.Join(dir, "a.txt"), "destination": filepath.Join(dir, "b.txt")}
+			},
+			locked: "b.txt",
+		},
+		{
+			name: "deletePath",
+			tool: "deletePath",
+			arguments: func(dir string) map[string]any {
+				return map[string]any{"path": filepath.Join(dir, "a.txt")}
+			},
+			locked: "a.txt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			h := newTestHandlerCfg(t, tmpDir)
+			os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("one\ntwo\n"), 0644)
+
+			unlock := h.locks.lock(filepath.Join(tmpDir, tt.locked))
+			done := make(chan *mcp.CallToolResult)
+			go func() {
+				done <- callTool(t, h, tt.tool, tt.arguments(tmpDir))
+			}()
+
+			select {
+			case result := <-done:
+				t.Fatalf("Expected %s to wait for the lock on %s, got %q", tt.tool, tt.locked, resultText(result))
+			case <-time.After(50 * time.Millisecond):
+			}
+			unlock()
+			<-done
+		})
+	}
+}
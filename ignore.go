@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ignoreFileNames are the files read in every directory to find entries to skip. Patterns from later
+// files take precedence over the earlier ones.
+var ignoreFileNames = []string{".gitignore", ".ignore", ".fsmcpignore"}
+
+// ignorePattern is a single line of an ignore file, following the .gitignore syntax
+type ignorePattern struct {
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreMatcher holds the patterns of every ignore file found from the root down to a directory.
+// Patterns from deeper directories come last, so they take precedence as they do in git.
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+func parseIgnorePatterns(base string, content []byte) []ignorePattern {
+	patterns := []ignorePattern{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := ignorePattern{base: base}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		p.pattern = line
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// withDir returns a matcher extended with the ignore files found in dir, a slash separated path
+// relative to the root
+func (m *ignoreMatcher) withDir(root *fsRoot, dir string) *ignoreMatcher {
+	extended := &ignoreMatcher{}
+	if m != nil {
+		extended.patterns = slices.Clip(m.patterns)
+	}
+
+	for _, name := range ignoreFileNames {
+		content, err := root.ReadFile(filepath.Join(root.dir, filepath.FromSlash(dir), name))
+		if err != nil {
+			continue
+		}
+		extended.patterns = append(extended.patterns, parseIgnorePatterns(dir, content)...)
+	}
+	return extended
+}
+
+// ignored reports whether a slash separated path relative to the root is matched by the ignore files.
+// The last matching pattern wins, and a negated pattern includes the path back.
+func (m *ignoreMatcher) ignored(relPath string, isDir bool) bool {
+	ignored := false
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+
+		name := relPath
+		if p.base != "." {
+			if !strings.HasPrefix(relPath, p.base+"/") {
+				continue
+			}
+			name = strings.TrimPrefix(relPath, p.base+"/")
+		}
+
+		matched := false
+		if p.anchored {
+			matched = matchGlob(p.pattern, name)
+		} else {
+			matched, _ = path.Match(p.pattern, path.Base(name))
+		}
+		if matched {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// ignoreFilter returns an entryFilter skipping the entries matched by the ignore files of a root.
+// Ignore files are read once per directory, from the root down to the directories being walked.
+func ignoreFilter(root *fsRoot) entryFilter {
+	matchers := map[string]*ignoreMatcher{}
+	var mu sync.Mutex
+
+	var matcherFor func(dir string) *ignoreMatcher
+	matcherFor = func(dir string) *ignoreMatcher {
+		if m, ok := matchers[dir]; ok {
+			return m
+		}
+		var parent *ignoreMatcher
+		if dir != "." {
+			parent = matcherFor(path.Dir(dir))
+		}
+		m := parent.withDir(root, dir)
+		matchers[dir] = m
+		return m
+	}
+
+	return func(entryPath string, entry os.DirEntry) bool {
+		relPath, err := root.rel(entryPath)
+		if err != nil {
+			return true
+		}
+		relPath = filepath.ToSlash(relPath)
+		mu.Lock()
+		matcher := matcherFor(path.Dir(relPath))
+		mu.Unlock()
+		return !matcher.ignored(relPath, entry.IsDir())
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreFilter(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := newTestRoot(t, tmpDir)
+
+	files := map[string]string{
+		".gitignore":               "*.log\nbuild/\n/dist\n!keep.log\n",
+		".fsmcpignore":             "secrets.txt\n",
+		"app.log":                  "",
+		"keep.log":                 "",
+		"main.go":                  "",
+		"secrets.txt":              "",
+		"build/output.bin":         "",
+		"dist/bundle.js":           "",
+		"web/dist/index.html":      "",
+		"web/.ignore":              "*.tmp\n!important.log\n",
+		"web/cache.tmp":            "",
+		"web/important.log":        "",
+		"web/debug.log":            "",
+		"web/node_modules/pkg.js":  "",
+		"web/src/.gitignore":       "generated/\n",
+		"web/src/generated/api.go": "",
+		"web/src/handler.go":       "",
+	}
+	for name, content := range files {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create test directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	expectContent := "- .fsmcpignore (file)\n" +
+		"- .gitignore (file)\n" +
+		"- keep.log (file)\n" +
+		"- main.go (file)\n" +
+		"- web (directory)\n" +
+		"  - .ignore (file)\n" +
+		"  - dist (directory)\n" +
+		"    - index.html (file)\n" +
+		"  - important.log (file)\n" +
+		"  - node_modules (directory)\n" +
+		"    - pkg.js (file)\n" +
+		"  - src (directory)\n" +
+		"    - .gitignore (file)\n" +
+		"    - handler.go (file)\n"
+
+	operationResult := listEntries(context.Background(), root, tmpDir, defaultListOptions, ignoreFilter(root))
+	if operationResult.Error != nil {
+		t.Fatalf("unexpected error: %v", operationResult.Error)
+	}
+	if operationResult.Content != expectContent {
+		t.Errorf("Expected:\n%v\nGot:\n%v", expectContent, operationResult.Content)
+	}
+
+	// Listing a subdirectory still applies the ignore files of its parents
+	expectContent = "- .gitignore (file)\n" +
+		"- handler.go (file)\n"
+
+	operationResult = listEntries(context.Background(), root, filepath.Join(tmpDir, "web", "src"), defaultListOptions, ignoreFilter(root))
+	if operationResult.Error != nil {
+		t.Fatalf("unexpected error: %v", operationResult.Error)
+	}
+	if operationResult.Content != expectContent {
+		t.Errorf("Expected:\n%v\nGot:\n%v", expectContent, operationResult.Content)
+	}
+}
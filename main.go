@@ -1,18 +1,32 @@
 package main
 
 import (
-	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 )
 
-func createMCPServer(handlerCfg *handlerCfg, pathMiddleware func(handlerFunc) server.ToolHandlerFunc) *server.MCPServer {
+type toolDefinition struct {
+	name        string
+	description string
+	params      []mcp.ToolOption
+	handler     handlerFunc
+	listsRoots  bool
+	readOnly    bool
+	pathAccess  pathAccess
+	// locksPaths is set when the handler locks the paths it changes itself, as they are only known once
+	// its arguments are parsed
+	locksPaths bool
+}
+
+func createMCPServer(handlerCfg *handlerCfg, pathMiddleware func(handlerFunc, pathAccess) server.ToolHandlerFunc) (*server.MCPServer, error) {
 	mcpServer := server.NewMCPServer(
 		"fs-mcp-server",
 		"1.0.0",
@@ -21,36 +35,75 @@ func createMCPServer(handlerCfg *handlerCfg, pathMiddleware func(handlerFunc) se
 	)
 
 	// Define all tools
-	tools := []struct {
-		name        string
-		description string
-		params      []mcp.ToolOption
-		handler     func(ctx context.Context, path string, request mcp.CallToolRequest) (*mcp.CallToolResult, error)
-	}{
+	tools := []toolDefinition{
 		{
 			name:        "listEntries",
 			description: "List entries at a given path",
 			params: []mcp.ToolOption{
 				mcp.WithString("path",
-					mcp.Required(),
-					mcp.Description("Path for which to list all entries"),
+					mcp.Description("Path for which to list all entries (leave empty to list the available roots)"),
 				),
 				mcp.WithNumber("depth",
 					mcp.Description("Depth of the directory tree (default is 3)"),
 				),
+				mcp.WithBoolean("includeIgnored",
+					mcp.Description("Also list entries matched by .gitignore, .ignore and .fsmcpignore files (default is false). Ignore files are only applied when the server runs with -ignore-files, otherwise nothing is left out and this has no effect."),
+				),
+				mcp.WithString("format",
+					mcp.Description("text for an indented list of names, json for a nested tree with the relative path, "+
+						"type, size, mode, modification time and symlink target of every entry (default is text)"),
+					mcp.Enum(listFormatText, listFormatJSON),
+				),
+				mcp.WithBoolean("showHidden",
+					mcp.Description("List the entries whose name starts with a dot (default is true)"),
+				),
+				mcp.WithString("type",
+					mcp.Description("Only list entries of this type, directories holding them are still listed to keep the tree shape"),
+					mcp.Enum(entryTypeFile, entryTypeDirectory, entryTypeSymlink),
+				),
+				mcp.WithString("include",
+					mcp.Description("Only list entries matching this glob, such as *.go or src/**/*.ts, directories holding them "+
+						"are still listed to keep the tree shape. Without a slash it matches names, with a slash paths relative to path"),
+				),
+				mcp.WithString("exclude",
+					mcp.Description("Leave out the entries matching this glob, and everything below them. "+
+						"Without a slash it matches names, with a slash paths relative to path"),
+				),
+				mcp.WithString("sortBy",
+					mcp.Description("Order of the entries of each directory: name, size with the largest first or mtime with the newest first (default is name)"),
+					mcp.Enum(listSortName, listSortSize, listSortMtime),
+				),
+				mcp.WithNumber("maxEntries",
+					mcp.Description("Maximum number of entries listed per directory, the others are summed up as N more entries (default is no limit)"),
+				),
 			},
-			handler: handlerCfg.handlerListEntries,
+			handler:    handlerCfg.handlerListEntries,
+			listsRoots: true,
+			readOnly:   true,
 		},
 		{
-			name:        "readFromFile",
-			description: "Read the contents of a file at a given path",
+			name: "readFromFile",
+			description: "Read the contents of a file at a given path. Use offset and limit to read part of a large file, " +
+				"the result then reports the returned range, the total number of lines and whether more content remains. " +
+				"The result also has the content hash of the whole file, to pass as expectedHash to the tools changing it",
 			params: []mcp.ToolOption{
 				mcp.WithString("path",
 					mcp.Required(),
 					mcp.Description("Path to the file to be read"),
 				),
+				mcp.WithNumber("offset",
+					mcp.Description("Number of lines (or bytes) to skip before reading (default is 0)"),
+				),
+				mcp.WithNumber("limit",
+					mcp.Description("Maximum number of lines (or bytes) to return (default is up to the end of the file)"),
+				),
+				mcp.WithString("unit",
+					mcp.Description("Unit of offset and limit (default is lines)"),
+					mcp.Enum(readUnitLines, readUnitBytes),
+				),
 			},
-			handler: handlerCfg.handlerReadFile,
+			handler:  handlerCfg.handlerReadFile,
+			readOnly: true,
 		},
 		{
 			name:        "writeToFile",
@@ -64,20 +117,37 @@ func createMCPServer(handlerCfg *handlerCfg, pathMiddleware func(handlerFunc) se
 					mcp.Required(),
 					mcp.Description("Content to write to the file"),
 				),
+				mcp.WithString("mode",
+					mcp.Description(fmt.Sprintf(
+						"Permission bits in octal, such as 0755 (default keeps the mode of an existing file, and is %04o for a new one)",
+						handlerCfg.perms.file,
+					)),
+				),
+				mcp.WithString("expectedHash",
+					mcp.Description("Content hash of the file, as returned by readFromFile or getFileInfo. The file is only written when it still has this hash"),
+				),
 			},
-			handler: handlerCfg.handlerWriteToFile,
+			handler:    handlerCfg.withExpectedHash(handlerCfg.handlerWriteToFile),
+			pathAccess: accessWrite,
 		},
 		{
 			name: "getFileInfo",
 			description: "Retrieve file information including size, last modified time, " +
-				"detected MIME type, and file permissions",
+				"detected MIME type, file permissions and content hash. For a directory, retrieve its number of entries, " +
+				"permissions and last modified time, and with aggregate the total size, file counts by extension " +
+				"and newest and oldest files of everything below it",
 			params: []mcp.ToolOption{
 				mcp.WithString("path",
 					mcp.Required(),
-					mcp.Description("Path to the file to retrieve information from"),
+					mcp.Description("Path to the file or directory to retrieve information from"),
+				),
+				mcp.WithBoolean("aggregate",
+					mcp.Description("For a directory, walk everything below it to compute the aggregate figures, "+
+						"which can take a while on large trees (default is false)"),
 				),
 			},
-			handler: handlerCfg.handlerGetFileInfo,
+			handler:  handlerCfg.handlerGetFileInfo,
+			readOnly: true,
 		},
 		{
 			name:        "renamePath",
@@ -91,8 +161,12 @@ func createMCPServer(handlerCfg *handlerCfg, pathMiddleware func(handlerFunc) se
 					mcp.Required(),
 					mcp.Description("New name for the file or directory (just the name, not the full path)"),
 				),
+				mcp.WithString("expectedHash",
+					mcp.Description("Content hash of the file, as returned by readFromFile or getFileInfo. The file is only renamed when it still has this hash"),
+				),
 			},
-			handler: handlerCfg.hadlerRenamePath,
+			handler:    handlerCfg.withExpectedHash(handlerCfg.hadlerRenamePath),
+			pathAccess: accessWrite,
 		},
 		{
 			name:        "copyFileOrDir",
@@ -106,53 +180,379 @@ func createMCPServer(handlerCfg *handlerCfg, pathMiddleware func(handlerFunc) se
 					mcp.Required(),
 					mcp.Description("Destination path where the file or directory will be copied"),
 				),
+				mcp.WithString("expectedHash",
+					mcp.Description("Content hash of the file, as returned by readFromFile or getFileInfo. The file is only copied when it still has this hash"),
+				),
+			},
+			handler: handlerCfg.withExpectedHash(handlerCfg.hadlerCopyFileOrDir),
+		},
+		{
+			name:        "createDirectory",
+			description: "Creates a new directory at a given path",
+			params: []mcp.ToolOption{
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Path of the directory to be created"),
+				),
+				mcp.WithBoolean("parents",
+					mcp.Description("Also create missing parent directories (default is false)"),
+				),
+				mcp.WithString("mode",
+					mcp.Description(fmt.Sprintf("Permission bits in octal, such as 0755 (default is %04o)", handlerCfg.perms.dir)),
+				),
+			},
+			handler:    handlerCfg.handlerCreateDirectory,
+			pathAccess: accessWrite,
+		},
+		{
+			name: "movePath",
+			description: "Moves a file or directory to a new location, possibly in another directory. " +
+				"Fails when the destination exists unless overwrite is set",
+			params: []mcp.ToolOption{
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Path to the file or directory to be moved"),
+				),
+				mcp.WithString("destination",
+					mcp.Required(),
+					mcp.Description("Destination path, including the final name of the file or directory"),
+				),
+				mcp.WithBoolean("overwrite",
+					mcp.Description("Replace the destination when it already exists and has the same type as the source (default is false)"),
+				),
+			},
+			handler:    handlerCfg.handlerMovePath,
+			pathAccess: accessWrite,
+		},
+		{
+			name: "deletePath",
+			description: "Deletes a file, or a directory with everything in it when recursive is set. " +
+				"When the server runs with trash enabled, the path is moved into the trash directory instead",
+			params: []mcp.ToolOption{
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Path to the file or directory to be deleted"),
+				),
+				mcp.WithBoolean("recursive",
+					mcp.Description("Must be true to delete a directory and all of its contents (default is false)"),
+				),
+			},
+			handler:    handlerCfg.handlerDeletePath,
+			pathAccess: accessWrite,
+		},
+		{
+			name: "editFile",
+			description: "Edits a file by replacing exact pieces of text, without rewriting the whole file. " +
+				"Each oldText must appear exactly once unless replaceAll is set, otherwise nothing is changed. " +
+				"Edits are applied in order and the result is a unified diff of the changes",
+			params: []mcp.ToolOption{
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Path to the file to be edited"),
+				),
+				mcp.WithArray("edits",
+					mcp.Required(),
+					mcp.Description("Replacements to make in the file"),
+					mcp.Items(map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"oldText": map[string]any{
+								"type":        "string",
+								"description": "Exact text to be replaced, including whitespace and line breaks",
+							},
+							"newText": map[string]any{
+								"type":        "string",
+								"description": "Text to replace it with",
+							},
+							"replaceAll": map[string]any{
+								"type":        "boolean",
+								"description": "Replace every occurrence of oldText instead of requiring a single one (default is false)",
+							},
+						},
+						"required": []string{"oldText", "newText"},
+					}),
+				),
 			},
-			handler: handlerCfg.hadlerCopyFileOrDir,
+			handler:    handlerCfg.handlerEditFile,
+			pathAccess: accessWrite,
 		},
+		{
+			name: "applyPatch",
+			description: "Applies a patch in the unified diff format, as produced by diff -u or git diff, possibly changing several files. " +
+				"Hunks whose context moved or slightly changed are still applied. Either every file is changed or none is, " +
+				"and the hunks that could not be applied are reported",
+			params: []mcp.ToolOption{
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Directory the file names in the patch are relative to"),
+				),
+				mcp.WithString("patch",
+					mcp.Required(),
+					mcp.Description("Patch in the unified diff format, the a/ and b/ prefixes of git diff are removed from the file names"),
+				),
+			},
+			handler:    handlerCfg.handlerApplyPatch,
+			locksPaths: true,
+		},
+		{
+			name: "appendToFile",
+			description: "Appends content at the end of a file, without reading or rewriting it. " +
+				"The file and its parent directories are created when missing",
+			params: []mcp.ToolOption{
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Path to the file to append to"),
+				),
+				mcp.WithString("content",
+					mcp.Required(),
+					mcp.Description("Content to append to the file"),
+				),
+				mcp.WithBoolean("ensureNewline",
+					mcp.Description("Start the content on a new line and end it with a line break (default is false)"),
+				),
+			},
+			handler:    handlerCfg.handlerAppendToFile,
+			pathAccess: accessWrite,
+		},
+		{
+			name: "insertLines",
+			description: "Inserts lines after a given line of a text file, without rewriting the whole file. " +
+				"The result shows the inserted lines, with their line numbers and the lines around them",
+			params: []mcp.ToolOption{
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Path to the file to insert lines into"),
+				),
+				mcp.WithNumber("line",
+					mcp.Required(),
+					mcp.Description("Line number after which the content is inserted, starting at 1 (0 inserts at the start of the file)"),
+				),
+				mcp.WithString("content",
+					mcp.Required(),
+					mcp.Description("Lines to insert"),
+				),
+				mcp.WithString("expectedHash",
+					mcp.Description("Content hash of the file, as returned by readFromFile or getFileInfo. The file is only changed when it still has this hash"),
+				),
+			},
+			handler:    handlerCfg.withExpectedHash(handlerCfg.handlerInsertLines),
+			pathAccess: accessWrite,
+		},
+		{
+			name: "deleteLines",
+			description: "Deletes a range of lines from a text file, without rewriting the whole file. " +
+				"The result shows the lines around the deleted ones, with their new line numbers",
+			params: []mcp.ToolOption{
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Path to the file to delete lines from"),
+				),
+				mcp.WithNumber("startLine",
+					mcp.Required(),
+					mcp.Description("First line to delete, starting at 1"),
+				),
+				mcp.WithNumber("endLine",
+					mcp.Description("Last line to delete, included (default is startLine)"),
+				),
+				mcp.WithString("expectedHash",
+					mcp.Description("Content hash of the file, as returned by readFromFile or getFileInfo. The file is only changed when it still has this hash"),
+				),
+			},
+			handler:    handlerCfg.withExpectedHash(handlerCfg.handlerDeleteLines),
+			pathAccess: accessWrite,
+		},
+		{
+			name: "searchFiles",
+			description: "Searches a directory and everything below it for files and directories by glob pattern, " +
+				"name or regex, optionally filtered by type, size and modification time. Every filter given must match",
+			params: []mcp.ToolOption{
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("Directory to search in"),
+				),
+				mcp.WithString("pattern",
+					mcp.Description("Glob pattern, such as *.go or src/**/*_test.go. Without a slash it matches names at any depth, "+
+						"with a slash it matches paths relative to the searched directory, where ** matches any number of directories"),
+				),
+				mcp.WithString("name",
+					mcp.Description("Text the name must contain, ignoring case"),
+				),
+				mcp.WithString("regex",
+					mcp.Description("Regular expression matched against paths relative to the searched directory"),
+				),
+				mcp.WithString("type",
+					mcp.Description("Type of the entries to find (default is every type)"),
+					mcp.Enum(entryTypeFile, entryTypeDirectory, entryTypeSymlink),
+				),
+				mcp.WithNumber("minSize",
+					mcp.Description("Minimum size in bytes, only files match when set"),
+				),
+				mcp.WithNumber("maxSize",
+					mcp.Description("Maximum size in bytes, only files match when set"),
+				),
+				mcp.WithString("modifiedAfter",
+					mcp.Description("Only match entries modified after this time, in the RFC 3339 format such as 2024-01-31T15:04:05Z"),
+				),
+				mcp.WithString("modifiedBefore",
+					mcp.Description("Only match entries modified before this time, in the RFC 3339 format such as 2024-01-31T15:04:05Z"),
+				),
+				mcp.WithNumber("maxResults",
+					mcp.Description("Maximum number of entries to return (default is 100)"),
+				),
+				mcp.WithBoolean("includeIgnored",
+					mcp.Description("Also search entries matched by .gitignore, .ignore and .fsmcpignore files (default is false). Ignore files are only applied when the server runs with -ignore-files, otherwise nothing is left out and this has no effect."),
+				),
+			},
+			handler:  handlerCfg.handlerSearchFiles,
+			readOnly: true,
+		},
+		{
+			name: "grepContent",
+			description: "Searches the text files at a path, or under it when it is a directory, for a regular expression. " +
+				"Matches are returned as path:line:column: text, and the lines around them as path-line- text. Binary files are skipped",
+			params: []mcp.ToolOption{
+				mcp.WithString("path",
+					mcp.Required(),
+					mcp.Description("File or directory to search in"),
+				),
+				mcp.WithString("pattern",
+					mcp.Required(),
+					mcp.Description("Regular expression in the Go syntax, matched against each line"),
+				),
+				mcp.WithBoolean("ignoreCase",
+					mcp.Description("Match the pattern ignoring case (default is false)"),
+				),
+				mcp.WithString("include",
+					mcp.Description("Glob the names of the files searched must match, such as *.go (default is every file)"),
+				),
+				mcp.WithNumber("contextLines",
+					mcp.Description("Number of lines to show before and after each match (default is 0)"),
+				),
+				mcp.WithNumber("maxResults",
+					mcp.Description("Maximum number of matches to return (default is 100)"),
+				),
+				mcp.WithBoolean("includeIgnored",
+					mcp.Description("Also search files matched by .gitignore, .ignore and .fsmcpignore files (default is false). Ignore files are only applied when the server runs with -ignore-files, otherwise nothing is left out and this has no effect."),
+				),
+			},
+			handler:  handlerCfg.handlerGrepContent,
+			readOnly: true,
+		},
+	}
+
+	// Make sure every tool named in the enabled and disabled lists exists
+	for _, names := range []map[string]bool{handlerCfg.enabledTools, handlerCfg.disabledTools} {
+		for name := range names {
+			if !slices.ContainsFunc(tools, func(tool toolDefinition) bool { return tool.name == name }) {
+				return nil, fmt.Errorf("unknown tool '%s'", name)
+			}
+		}
 	}
 
-	// Add all tools to the server
+	// Add all tools to the server, leaving out the ones that modify the file system in read-only mode
+	// and the ones that are not enabled
 	for _, tool := range tools {
+		if handlerCfg.readOnly && !tool.readOnly {
+			continue
+		}
+		if !handlerCfg.isToolEnabled(tool.name) {
+			continue
+		}
+
 		t := mcp.NewTool(tool.name,
 			append([]mcp.ToolOption{
 				mcp.WithDescription(tool.description),
+				mcp.WithReadOnlyHintAnnotation(tool.readOnly),
 			}, tool.params...)...,
 		)
+		toolHandler := tool.handler
+		if !tool.readOnly && !tool.locksPaths {
+			toolHandler = handlerCfg.withPathLock(toolHandler)
+		}
+		handler := pathMiddleware(toolHandler, tool.pathAccess)
+		if tool.listsRoots {
+			handler = handlerCfg.withRootsListing(handler)
+		}
 		mcpServer.AddTool(
 			t,
-			handlersMiddleware(tool.name, pathMiddleware(tool.handler)),
+			handlersMiddleware(tool.name, handlerCfg.withResponseLimit(tool.name, handler)),
 		)
 	}
 
-	return mcpServer
+	return mcpServer, nil
 }
 
-func fileSystemMCP(handlerCfg *handlerCfg) *server.MCPServer {
+func fileSystemMCP(handlerCfg *handlerCfg) (*server.MCPServer, error) {
 	return createMCPServer(handlerCfg, handlerCfg.withSafePath)
 }
 
-func fileSystemDockerMCP(handlerCfg *handlerCfg) *server.MCPServer {
+func fileSystemDockerMCP(handlerCfg *handlerCfg) (*server.MCPServer, error) {
 	return createMCPServer(handlerCfg, handlerCfg.withDockerPath)
 }
 
+// parseToolNames splits a comma separated list of tool names into a set
+func parseToolNames(value string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// dirFlags collects every -dir flag given, so several roots can be served at once
+type dirFlags []string
+
+func (d *dirFlags) String() string {
+	return strings.Join(*d, ", ")
+}
+
+func (d *dirFlags) Set(value string) error {
+	*d = append(*d, value)
+	return nil
+}
+
 func main() {
 	var port int
-	var dir string
+	var dirs dirFlags
 	var transport string
 	var dockerMode bool
 	var volumeMapping string
+	var symlinks string
+	var readOnly bool
+	var enableTools string
+	var disableTools string
+	var rulesFile string
+	var ignoreFiles bool
+	var trash bool
+	var maxResponse int
+	var fileMode string
+	var dirMode string
 
 	flag.IntVar(&port, "port", 8080, "Port to listen on (optional)")
-	flag.StringVar(&dir, "dir", "", "Directory to serve")
+	flag.Var(&dirs, "dir", "Directory to serve in format '[name=]path[:ro|:rw]' (can be repeated)")
 	flag.StringVar(&transport, "t", "stdio", "Transport type (stdio or http)")
 	flag.StringVar(&volumeMapping, "volume", "", "Volume mapping in format 'hostPath:containerPath'")
+	flag.StringVar(&symlinks, "symlinks", "follow-within-root", "Symlink policy (deny, follow-within-root or follow-anywhere)")
+	flag.BoolVar(&readOnly, "read-only", false, "Serve every directory read-only and only register tools that do not modify files")
+	flag.StringVar(&enableTools, "enable-tools", "", "Comma separated list of the only tools to register (default is all tools)")
+	flag.StringVar(&disableTools, "disable-tools", "", "Comma separated list of tools to leave out")
+	flag.StringVar(&rulesFile, "rules", "", "File with ordered allow/deny glob rules for paths inside the served directories")
+	flag.BoolVar(&ignoreFiles, "ignore-files", false, "Skip entries matched by .gitignore, .ignore and .fsmcpignore files in listEntries, searchFiles and grepContent (ignore files are not applied without it)")
+	flag.IntVar(&maxResponse, "max-response-size", 256*1024, "Maximum size in bytes of the text returned by a tool, longer responses are truncated (0 for no limit)")
+	flag.StringVar(&fileMode, "file-mode", fmt.Sprintf("%04o", defaultFilePerms.file), "Permission bits in octal of the files created by the server")
+	flag.StringVar(&dirMode, "dir-mode", fmt.Sprintf("%04o", defaultFilePerms.dir), "Permission bits in octal of the directories created by the server")
+	flag.BoolVar(&trash, "trash", false, "Move deleted paths into a "+trashDirName+" directory inside their root instead of removing them")
 
 	flag.Parse()
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `fs-mcp - A simple filesystem MCP
 
 Usage:
-	fs-mcp --dir <directory> [--port <port>] [-t <transport>]
+	fs-mcp --dir <directory> [--dir <directory>...] [--port <port>] [-t <transport>] [-symlinks <policy>] [-read-only]
+	       [-enable-tools <tool,...>] [-disable-tools <tool,...>] [-rules <file>] [-ignore-files] [-trash] [-max-response-size <bytes>]
+	       [-file-mode <mode>] [-dir-mode <mode>]
 
 Options:
 `)
@@ -161,9 +561,34 @@ Options:
 
 	dockerMode = os.Getenv("FS_MCP_DOCKER_MODE") == "true"
 
+	policy, err := parseSymlinkPolicy(symlinks)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	perms := filePerms{}
+	if perms.file, err = parseFileMode(fileMode); err != nil {
+		fmt.Printf("ERROR: invalid -file-mode flag: %v\n", err)
+		os.Exit(1)
+	}
+	if perms.dir, err = parseFileMode(dirMode); err != nil {
+		fmt.Printf("ERROR: invalid -dir-mode flag: %v\n", err)
+		os.Exit(1)
+	}
+
+	var rules pathRules
+	if rulesFile != "" {
+		rules, err = loadRules(rulesFile)
+		if err != nil {
+			fmt.Printf("ERROR: error reading the rules file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// directory resolution
 	var volumeStringSlices []string
-	finalDir := ""
+	var specs []rootSpec
 	switch {
 	case dockerMode && volumeMapping == "":
 		fmt.Printf("ERROR: volume flag must be provided when using docker mode\n")
@@ -175,38 +600,71 @@ Options:
 			os.Exit(1)
 		}
 
-		if dir != "" && dir != volumeStringSlices[1] {
+		if len(dirs) > 0 && (len(dirs) != 1 || dirs[0] != volumeStringSlices[1]) {
 			fmt.Printf("WARNING: your base directory passed in -dir flag will be overwritten by %s\n", volumeStringSlices[1])
 		}
-		finalDir = volumeStringSlices[1]
+		specs = []rootSpec{{name: filepath.Base(volumeStringSlices[1]), dir: volumeStringSlices[1]}}
 
 		if transport != "http" {
 			fmt.Println("WARNING: when running in docker mode, transport type is http by default")
 		}
-	case dir != "":
+	case len(dirs) > 0:
 		if volumeMapping != "" {
 			fmt.Println("WARNING: -volume flag is used only when running in docker mode. Flag will be ignored")
 		}
-		finalDir = dir
+		names := map[string]bool{}
+		for _, dir := range dirs {
+			spec, err := parseRootSpec(dir)
+			if err != nil {
+				fmt.Printf("ERROR: invalid -dir flag: %v\n", err)
+				os.Exit(1)
+			}
+			if names[spec.name] {
+				fmt.Printf("ERROR: root name '%s' is used more than once, set a unique name with 'name=path'\n", spec.name)
+				os.Exit(1)
+			}
+			names[spec.name] = true
+			specs = append(specs, spec)
+		}
 	default:
 		log.Println("Error: -dir is required")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	_, err, exists := assertPath(finalDir)
-	if err != nil {
-		fmt.Printf("ERROR: error reading the base path: %v\n", err)
-		os.Exit(1)
-	}
-	if !exists {
-		fmt.Printf("ERROR: base path not found: %v\n", finalDir)
-		os.Exit(1)
+	var roots []*fsRoot
+	for _, spec := range specs {
+		if readOnly {
+			spec.readOnly = true
+		}
+		root, err := openRoot(spec, policy)
+		if os.IsNotExist(err) {
+			fmt.Printf("ERROR: base path not found: %v\n", spec.dir)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Printf("ERROR: error reading the base path: %v\n", err)
+			os.Exit(1)
+		}
+		defer root.Close()
+		roots = append(roots, root)
 	}
 
 	// Choose the appropriate MCP server based on dockerMode
 	var mcpServer *server.MCPServer
-	handlerCfg := &handlerCfg{baseDir: finalDir, dockerMode: dockerMode}
+	handlerCfg := &handlerCfg{
+		roots:         roots,
+		dockerMode:    dockerMode,
+		symlinkPolicy: policy,
+		readOnly:      readOnly,
+		enabledTools:  parseToolNames(enableTools),
+		disabledTools: parseToolNames(disableTools),
+		rules:         rules,
+		ignoreFiles:   ignoreFiles,
+		trash:         trash,
+		maxResponse:   maxResponse,
+		perms:         perms,
+	}
 	if dockerMode {
 		if len(volumeStringSlices) == 2 {
 			handlerCfg.volumeMapping = &VolumeMapping{
@@ -215,7 +673,11 @@ Options:
 			}
 		}
 
-		mcpServer = fileSystemDockerMCP(handlerCfg)
+		mcpServer, err = fileSystemDockerMCP(handlerCfg)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(1)
+		}
 		addr := fmt.Sprintf(":%d", port)
 		sseServer := server.NewSSEServer(mcpServer, server.WithBaseURL("http://localhost"+addr))
 		log.Printf("SSE server listening on %s in docker mode", addr)
@@ -224,7 +686,11 @@ Options:
 		}
 		return
 	} else {
-		mcpServer = fileSystemMCP(handlerCfg)
+		mcpServer, err = fileSystemMCP(handlerCfg)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
 	// Start the server based on transport
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// toolNames returns the sorted names of the tools the server registers
+func toolNames(t *testing.T, h *handlerCfg) []string {
+	t.Helper()
+
+	mcpServer, err := fileSystemMCP(h)
+	if err != nil {
+		t.Fatalf("Failed to create the server: %v", err)
+	}
+	var list struct {
+		Tools []struct {
+			Name string `json:"name"`
+		} `json:"tools"`
+	}
+	if err := json.Unmarshal(callServer(t, mcpServer, "tools/list", map[string]any{}), &list); err != nil {
+		t.Fatalf("Failed to decode the tools list: %v", err)
+	}
+	names := []string{}
+	for _, tool := range list.Tools {
+		names = append(names, tool.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestReadOnlyTools(t *testing.T) {
+	tests := []struct {
+		name        string
+		readOnly    bool
+		expectTools []string
+	}{
+		{
+			name:     "read-write",
+			readOnly: false,
+			expectTools: []string{
+				"appendToFile", "applyPatch", "copyFileOrDir", "createDirectory", "deleteLines", "deletePath",
+				"editFile", "getFileInfo", "grepContent", "insertLines", "listEntries", "movePath",
+				"readFromFile", "renamePath", "searchFiles", "writeToFile",
+			},
+		},
+		{
+			name:        "read-only",
+			readOnly:    true,
+			expectTools: []string{"getFileInfo", "grepContent", "listEntries", "readFromFile", "searchFiles"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandlerCfg(t, t.TempDir())
+			h.readOnly = tt.readOnly
+			if got := toolNames(t, h); !reflect.DeepEqual(got, tt.expectTools) {
+				t.Errorf("Got tools %v, expected: %v", got, tt.expectTools)
+			}
+		})
+	}
+}
+
+func TestToolSelection(t *testing.T) {
+	tests := []struct {
+		name         string
+		enableTools  string
+		disableTools string
+		readOnly     bool
+		expectTools  []string
+		expectErr    string
+	}{
+		{
+			name:        "enable tools",
+			enableTools: "readFromFile,listEntries",
+			expectTools: []string{"listEntries", "readFromFile"},
+		},
+		{
+			name:         "disable tools",
+			disableTools: "deletePath, movePath , applyPatch",
+			expectTools: []string{
+				"appendToFile", "copyFileOrDir", "createDirectory", "deleteLines", "editFile", "getFileInfo",
+				"grepContent", "insertLines", "listEntries", "readFromFile", "renamePath", "searchFiles", "writeToFile",
+			},
+		},
+		{
+			name:         "disabled tools win over enabled tools",
+			enableTools:  "readFromFile,writeToFile,deletePath",
+			disableTools: "deletePath",
+			expectTools:  []string{"readFromFile", "writeToFile"},
+		},
+		{
+			name:        "read-only leaves out enabled tools that modify files",
+			enableTools: "readFromFile,writeToFile",
+			readOnly:    true,
+			expectTools: []string{"readFromFile"},
+		},
+		{
+			name:        "unknown enabled tool",
+			enableTools: "readFromFile,readFile",
+			expectErr:   "unknown tool 'readFile'",
+		},
+		{
+			name:         "unknown disabled tool",
+			disableTools: "removePath",
+			expectErr:    "unknown tool 'removePath'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandlerCfg(t, t.TempDir())
+			h.enabledTools = parseToolNames(tt.enableTools)
+			h.disabledTools = parseToolNames(tt.disableTools)
+			h.readOnly = tt.readOnly
+
+			if tt.expectErr != "" {
+				if _, err := fileSystemMCP(h); err == nil || err.Error() != tt.expectErr {
+					t.Errorf("Got error %v, expected: %s", err, tt.expectErr)
+				}
+				return
+			}
+			if got := toolNames(t, h); !reflect.DeepEqual(got, tt.expectTools) {
+				t.Errorf("Got tools %v, expected: %v", got, tt.expectTools)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathAccess is the kind of access a tool needs on a path
+type pathAccess int
+
+const (
+	accessRead pathAccess = iota
+	accessWrite
+)
+
+func (a pathAccess) String() string {
+	if a == accessWrite {
+		return "write"
+	}
+	return "read"
+}
+
+// pathRule allows or denies access to the paths matching a glob pattern. Patterns follow the
+// .gitignore conventions: a pattern without a slash matches a name at any depth, a pattern with a
+// slash is anchored to the root, a trailing slash only matches directories and "**" matches any number
+// of directories. A rule matching a directory applies to everything below it.
+type pathRule struct {
+	allow   bool
+	read    bool
+	write   bool
+	pattern string
+}
+
+// pathRules are evaluated in order and the first matching rule wins. Paths no rule matches are allowed.
+type pathRules []pathRule
+
+// parseRules reads rules, one per line, in the format "<allow|deny> <read|write|rw> <pattern>".
+// Empty lines and lines starting with '#' are ignored.
+func parseRules(r io.Reader) (pathRules, error) {
+	rules := pathRules{}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected '<allow|deny> <read|write|rw> <pattern>'", lineNumber)
+		}
+
+		rule := pathRule{pattern: fields[2]}
+		switch fields[0] {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("line %d: unknown action '%s'", lineNumber, fields[0])
+		}
+		switch fields[1] {
+		case "read":
+			rule.read = true
+		case "write":
+			rule.write = true
+		case "rw":
+			rule.read, rule.write = true, true
+		default:
+			return nil, fmt.Errorf("line %d: unknown scope '%s'", lineNumber, fields[1])
+		}
+		if _, err := path.Match(strings.Trim(rule.pattern, "/"), ""); err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern '%s': %s", lineNumber, rule.pattern, err)
+		}
+
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func loadRules(file string) (pathRules, error) {
+	f, err := os.Open(file) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRules(f)
+}
+
+// allows reports whether the given access is allowed on a path relative to its root
+func (rules pathRules) allows(relPath string, isDir bool, access pathAccess) bool {
+	relPath = filepath.ToSlash(relPath)
+	if relPath == "." || relPath == "" {
+		return true
+	}
+
+	for _, rule := range rules {
+		if access == accessRead && !rule.read || access == accessWrite && !rule.write {
+			continue
+		}
+		if rule.matches(relPath, isDir) {
+			return rule.allow
+		}
+	}
+	return true
+}
+
+func (rule pathRule) matches(relPath string, isDir bool) bool {
+	pattern := rule.pattern
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	parts := strings.Split(relPath, "/")
+	for i := range parts {
+		if dirOnly && i == len(parts)-1 && !isDir {
+			break
+		}
+		if anchored {
+			if matchGlob(pattern, strings.Join(parts[:i+1], "/")) {
+				return true
+			}
+		} else if ok, _ := path.Match(pattern, parts[i]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether a slash separated path matches a glob pattern. Besides the syntax of
+// path.Match, a "**" element matches any number of path elements, including none.
+func matchGlob(pattern, name string) bool {
+	return matchGlobParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{pattern: "*.go", name: "main.go", expected: true},
+		{pattern: "*.go", name: "cmd/main.go", expected: false},
+		{pattern: "**/*.go", name: "main.go", expected: true},
+		{pattern: "**/*.go", name: "cmd/server/main.go", expected: true},
+		{pattern: "cmd/**", name: "cmd/server/main.go", expected: true},
+		{pattern: "cmd/**/main.go", name: "cmd/main.go", expected: true},
+		{pattern: "cmd/**/main.go", name: "pkg/main.go", expected: false},
+		{pattern: "file_?.txt", name: "file_1.txt", expected: true},
+		{pattern: "file_[0-9].txt", name: "file_a.txt", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			if actual := matchGlob(tt.pattern, tt.name); actual != tt.expected {
+				t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		expectRules int
+		expectErr   bool
+	}{
+		{
+			name: "valid rules",
+			content: "# secrets\n" +
+				"allow read .env.example\n" +
+				"deny rw .env*\n" +
+				"\n" +
+				"deny write .git/\n",
+			expectRules: 3,
+		},
+		{
+			name:      "unknown action",
+			content:   "block rw .env\n",
+			expectErr: true,
+		},
+		{
+			name:      "unknown scope",
+			content:   "deny all .env\n",
+			expectErr: true,
+		},
+		{
+			name:      "missing pattern",
+			content:   "deny rw\n",
+			expectErr: true,
+		},
+		{
+			name:      "invalid pattern",
+			content:   "deny rw [.env\n",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseRules(strings.NewReader(tt.content))
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("Expected error, got %+v", rules)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(rules) != tt.expectRules {
+				t.Errorf("Got %d rules, expected: %d", len(rules), tt.expectRules)
+			}
+		})
+	}
+}
+
+func TestPathRulesAllows(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(
+		"allow read .env.example\n" +
+			"deny rw .env*\n" +
+			"deny rw *.pem\n" +
+			"deny rw .git/\n" +
+			"deny rw node_modules/\n" +
+			"deny write /docs/**/*.md\n",
+	))
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		isDir    bool
+		access   pathAccess
+		expected bool
+	}{
+		{name: "regular file", path: "src/main.go", access: accessRead, expected: true},
+		{name: "root itself", path: ".", isDir: true, access: accessWrite, expected: true},
+		{name: "env file at the root", path: ".env", access: accessRead, expected: false},
+		{name: "env file in a subdirectory", path: "app/.env.local", access: accessWrite, expected: false},
+		{name: "allowed before denied", path: "app/.env.example", access: accessRead, expected: true},
+		{name: "allow rule scoped to read", path: "app/.env.example", access: accessWrite, expected: false},
+		{name: "certificate", path: "certs/server.pem", access: accessRead, expected: false},
+		{name: "git directory", path: ".git", isDir: true, access: accessRead, expected: false},
+		{name: "file inside git directory", path: ".git/config", access: accessRead, expected: false},
+		{name: "file named like a denied directory", path: "notes/.git", access: accessRead, expected: true},
+		{name: "nested node_modules", path: "web/node_modules/react/index.js", access: accessRead, expected: false},
+		{name: "anchored pattern read", path: "docs/guide/intro.md", access: accessRead, expected: true},
+		{name: "anchored pattern write", path: "docs/guide/intro.md", access: accessWrite, expected: false},
+		{name: "anchored pattern elsewhere", path: "src/docs/intro.md", access: accessWrite, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := rules.allows(tt.path, tt.isDir, tt.access); actual != tt.expected {
+				t.Errorf("allows(%q, %v, %s) = %v, want %v", tt.path, tt.isDir, tt.access, actual, tt.expected)
+			}
+		})
+	}
+}